@@ -38,3 +38,96 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrCorruptRecord struct {
+	Offset uint64
+}
+
+// GRPCStatus returns a gRPC status with the error details set.
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss,
+		fmt.Sprintf("record corrupted: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record at the requested offset failed its integrity check: %d",
+		e.Offset,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// Error implements the error interface.
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOffsetCompacted struct {
+	Offset uint64
+}
+
+// GRPCStatus returns a gRPC status with the error details set.
+func (e ErrOffsetCompacted) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("offset compacted: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record at the requested offset was removed by log compaction: %d",
+		e.Offset,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// Error implements the error interface.
+func (e ErrOffsetCompacted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidRecord struct {
+	Reason string
+}
+
+// GRPCStatus returns a gRPC status with the error details set.
+func (e ErrInvalidRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid record: %s", e.Reason),
+	)
+	msg := fmt.Sprintf(
+		"The record can't be appended to the log: %s",
+		e.Reason,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// Error implements the error interface.
+func (e ErrInvalidRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
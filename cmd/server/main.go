@@ -1,12 +1,43 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/sota0121/proglog/internal/server"
+	"github.com/sota0121/proglog/internal/agent"
+	"github.com/sota0121/proglog/internal/config"
 )
 
 func main() {
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
+	c, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a, err := agent.New(c.Agent())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("serving gRPC on %s and HTTP on %s", c.GRPCAddr, c.HTTPAddr)
+
+	// Run until we are told to stop or a server fails.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-sigc:
+	case <-a.Done():
+	}
+	if err := a.Shutdown(); err != nil {
+		log.Fatal(err)
+	}
+	if err := a.Err(); err != nil {
+		log.Fatalf("server failed: %v", err)
+	}
 }
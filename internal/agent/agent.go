@@ -0,0 +1,349 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sota0121/proglog/internal/auth"
+	"github.com/sota0121/proglog/internal/log"
+	"github.com/sota0121/proglog/internal/server"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// defaultShutdownTimeout bounds how long Shutdown waits for in-flight requests.
+const defaultShutdownTimeout = 10 * time.Second
+
+// Config configures an Agent.
+type Config struct {
+	DataDir         string        // directory of the commit log
+	GRPCAddr        string        // address of the gRPC server
+	HTTPAddr        string        // address of the JSON API
+	ShutdownTimeout time.Duration // how long Shutdown waits for in-flight requests
+	Log             log.Config    // configuration of the commit log
+	// TLS, if set, makes the servers accept TLS connections only.
+	// The client CA applies to the gRPC server; clients of the JSON API
+	// don't need a certificate.
+	TLS *server.TLSConfig
+	// PolicyFile, if set, is the file of the policies which permit
+	// the clients to produce and consume, as read by auth.New.
+	// Clients of the gRPC server are identified by their certificate
+	// and clients of the JSON API by their bearer token.
+	PolicyFile string
+	// TokensFile or JWTKeyFile, if set, makes the JSON API require
+	// bearer tokens: either the static tokens of the file, as read by
+	// auth.LoadTokens, or JWTs signed with the key of the file.
+	TokensFile string
+	JWTKeyFile string
+
+	// Logger, if set, receives the messages of the agent, such as what was
+	// repaired in the commit log. It defaults to JSON on stderr.
+	Logger      *zap.Logger
+	LogRequests bool   // log every gRPC request to the Logger
+	MetricsAddr string // if set, serve Prometheus metrics at /metrics on this address
+	// TraceFile, if set, is the file to export the traces of the gRPC
+	// requests to as JSON, or "-" for stdout.
+	TraceFile string
+}
+
+// Agent runs a commit log with the gRPC server and the JSON API in front of it.
+type Agent struct {
+	Config
+
+	log        *log.Log
+	grpcServer *grpc.Server
+	httpServer *http.Server
+	grpcLn     net.Listener
+	httpLn     net.Listener
+	drain      chan struct{} // closed to end the streams when shutting down
+
+	logger         *zap.Logger
+	metrics        *server.Metrics
+	metricsServer  *http.Server
+	metricsLn      net.Listener
+	tracerProvider *sdktrace.TracerProvider
+	traceFile      *os.File
+
+	shutdownMu sync.Mutex
+	shutdown   bool
+	done       chan struct{} // closed once the agent has shut down
+	err        error         // error of the server which made the agent shut down
+}
+
+// New opens the commit log and starts serving it.
+func New(config Config) (*Agent, error) {
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	a := &Agent{
+		Config: config,
+		drain:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	setup := []func() error{
+		a.setupLogger,
+		a.setupLog,
+		a.setupObservability,
+		a.setupServers,
+	}
+	for _, fn := range setup {
+		if err := fn(); err != nil {
+			_ = a.Shutdown()
+			return nil, err
+		}
+	}
+	a.serve()
+	return a, nil
+}
+
+func (a *Agent) setupLogger() error {
+	a.logger = a.Logger
+	if a.logger != nil {
+		return nil
+	}
+	var err error
+	a.logger, err = zap.NewProduction()
+	return err
+}
+
+// setupLog opens the commit log and reports what it repaired
+// after an unclean shutdown.
+func (a *Agent) setupLog() error {
+	if err := os.MkdirAll(a.DataDir, 0755); err != nil {
+		return err
+	}
+	var err error
+	if a.log, err = log.NewLog(a.DataDir, a.Config.Log); err != nil {
+		return err
+	}
+	for _, r := range a.log.Repairs() {
+		a.logger.Warn("repaired segment",
+			zap.Uint64("base_offset", r.BaseOffset),
+			zap.Uint64("truncated_bytes", r.TruncatedBytes),
+			zap.Uint64("dropped_entries", r.DroppedEntries),
+			zap.Uint64("rebuilt_entries", r.RebuiltEntries),
+			zap.Bool("index_rebuilt", r.IndexRebuilt),
+		)
+	}
+	return nil
+}
+
+// setupObservability sets up the metrics and the tracing of the requests
+// as configured.
+func (a *Agent) setupObservability() error {
+	if a.MetricsAddr != "" {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+		var err error
+		if a.metrics, err = server.NewMetrics(reg); err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		a.metricsServer = &http.Server{Addr: a.MetricsAddr, Handler: mux}
+		if a.metricsLn, err = net.Listen("tcp", a.MetricsAddr); err != nil {
+			return err
+		}
+	}
+	if a.TraceFile != "" {
+		w := os.Stdout
+		if a.TraceFile != "-" {
+			var err error
+			a.traceFile, err = os.OpenFile(a.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			w = a.traceFile
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return err
+		}
+		a.tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	}
+	return nil
+}
+
+func (a *Agent) setupServers() error {
+	config := &server.Config{
+		CommitLog: a.log,
+		Drain:     a.drain,
+		TLS:       a.TLS,
+		Metrics:   a.metrics,
+	}
+	if a.LogRequests {
+		config.Logger = a.logger
+	}
+	if a.tracerProvider != nil { // not a nil *TracerProvider in the interface
+		config.TracerProvider = a.tracerProvider
+	}
+	if a.PolicyFile != "" {
+		authorizer, err := auth.New(a.PolicyFile)
+		if err != nil {
+			return err
+		}
+		config.Authorizer = authorizer
+	}
+	switch {
+	case a.TokensFile != "":
+		tokens, err := auth.LoadTokens(a.TokensFile)
+		if err != nil {
+			return err
+		}
+		config.TokenVerifier = tokens
+	case a.JWTKeyFile != "":
+		verifier, err := auth.NewJWTVerifier(a.JWTKeyFile)
+		if err != nil {
+			return err
+		}
+		config.TokenVerifier = verifier
+	}
+	var err error
+	if a.grpcServer, err = server.NewGRPCServer(config); err != nil {
+		return err
+	}
+	a.httpServer = server.NewHTTPServer(a.HTTPAddr, config)
+
+	if a.grpcLn, err = net.Listen("tcp", a.GRPCAddr); err != nil {
+		return err
+	}
+	if a.httpLn, err = net.Listen("tcp", a.HTTPAddr); err != nil {
+		return err
+	}
+	if a.TLS != nil {
+		tlsConfig, err := a.TLS.ServerTLSConfig()
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientAuth = tls.NoClientCert
+		tlsConfig.ClientCAs = nil
+		a.httpLn = tls.NewListener(a.httpLn, tlsConfig)
+	}
+	return nil
+}
+
+// serve serves the gRPC server and the JSON API in the background.
+// The agent shuts down if either of them fails. See Done and Err.
+func (a *Agent) serve() {
+	go func() {
+		if err := a.grpcServer.Serve(a.grpcLn); err != nil {
+			a.fail(err)
+		}
+	}()
+	go func() {
+		if err := a.httpServer.Serve(a.httpLn); err != http.ErrServerClosed {
+			a.fail(err)
+		}
+	}()
+	if a.metricsServer != nil {
+		go func() {
+			if err := a.metricsServer.Serve(a.metricsLn); err != http.ErrServerClosed {
+				a.fail(err)
+			}
+		}()
+	}
+}
+
+// fail shuts the agent down because a server failed with err.
+// Errors of the servers which are being shut down are ignored.
+func (a *Agent) fail(err error) {
+	a.shutdownMu.Lock()
+	if !a.shutdown && a.err == nil {
+		a.err = err
+	}
+	a.shutdownMu.Unlock()
+	_ = a.Shutdown()
+}
+
+// Done returns a channel which is closed once the agent has shut down,
+// either by Shutdown or because a server failed.
+func (a *Agent) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err returns the error of the server which made the agent shut down,
+// or nil if it was shut down by Shutdown. It is set once Done is closed.
+func (a *Agent) Err() error {
+	a.shutdownMu.Lock()
+	defer a.shutdownMu.Unlock()
+	return a.err
+}
+
+// Shutdown stops the servers and closes the commit log:
+//   - the servers stop accepting connections and requests
+//   - streams and long polls end with codes.Unavailable
+//   - in-flight requests, such as appends, finish within ShutdownTimeout,
+//     after which the remaining ones are cancelled
+//   - the traces of the last requests are exported
+//   - the commit log is synced and closed
+//
+// It is safe to call more than once.
+func (a *Agent) Shutdown() error {
+	a.shutdownMu.Lock()
+	defer a.shutdownMu.Unlock()
+	if a.shutdown {
+		return nil
+	}
+	a.shutdown = true
+	defer close(a.done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.ShutdownTimeout)
+	defer cancel()
+	close(a.drain)
+	for _, srv := range []*http.Server{a.httpServer, a.metricsServer} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			_ = srv.Close()
+		}
+	}
+	if a.grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			a.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			// Appends which are still running finish before the log
+			// is closed, and the later ones fail.
+			a.grpcServer.Stop()
+			<-stopped
+		}
+	}
+	// The listeners are closed by the servers once they serve.
+	for _, ln := range []net.Listener{a.grpcLn, a.httpLn, a.metricsLn} {
+		if ln != nil {
+			_ = ln.Close()
+		}
+	}
+	// Export the traces of the last requests.
+	if a.tracerProvider != nil {
+		_ = a.tracerProvider.Shutdown(ctx)
+	}
+	if a.traceFile != nil {
+		_ = a.traceFile.Close()
+	}
+	if a.logger != nil {
+		_ = a.logger.Sync()
+	}
+	if a.log != nil {
+		return a.log.Close()
+	}
+	return nil
+}
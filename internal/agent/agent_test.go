@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/sota0121/proglog/api/v1"
+	"github.com/sota0121/proglog/internal/log"
+	"github.com/sota0121/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	zapobserver "go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestAgent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := New(Config{
+		DataDir:  dir,
+		GRPCAddr: "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+	})
+	require.NoError(t, err)
+
+	// Produce a record over gRPC.
+	cc, err := grpc.Dial(
+		a.grpcLn.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+	produce, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	// Consume it over the JSON API.
+	b, err := json.Marshal(server.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	req, err := http.NewRequest("GET", "http://"+a.httpLn.Addr().String(), bytes.NewReader(b))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var consume server.ConsumeResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&consume))
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+
+	// Shutting down closes the log, so the record survives a restart.
+	require.NoError(t, a.Shutdown())
+	require.NoError(t, a.Shutdown())
+	<-a.Done()
+	require.NoError(t, a.Err())
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	require.Empty(t, clog.Repairs())
+	record, err := clog.Read(produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+// TestAgentShutdown tests that shutting down ends the streams and closes the log
+// without waiting for the shutdown timeout.
+func TestAgentShutdown(t *testing.T) {
+	dir, err := os.MkdirTemp("", "agent-shutdown-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := New(Config{
+		DataDir:         dir,
+		GRPCAddr:        "127.0.0.1:0",
+		HTTPAddr:        "127.0.0.1:0",
+		ShutdownTimeout: time.Minute,
+	})
+	require.NoError(t, err)
+
+	cc, err := grpc.Dial(
+		a.grpcLn.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+
+	// Follow the empty log.
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	// Keep a producer idle.
+	produceStream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, a.Shutdown())
+	require.Less(t, time.Since(start), a.ShutdownTimeout)
+
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = produceStream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = a.log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, log.ErrClosed, err)
+}
+
+// TestAgentObservability tests that the agent serves the metrics
+// and exports the traces of the requests.
+func TestAgentObservability(t *testing.T) {
+	dir, err := os.MkdirTemp("", "agent-observability-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	traceFile := filepath.Join(dir, "traces.json")
+	a, err := New(Config{
+		DataDir:     filepath.Join(dir, "data"),
+		GRPCAddr:    "127.0.0.1:0",
+		HTTPAddr:    "127.0.0.1:0",
+		MetricsAddr: "127.0.0.1:0",
+		TraceFile:   traceFile,
+	})
+	require.NoError(t, err)
+
+	cc, err := grpc.Dial(
+		a.grpcLn.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	_, err = api.NewLogClient(cc).Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	resp, err := http.Get("http://" + a.metricsLn.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `proglog_grpc_requests_total{code="OK",method="/log.v1.Log/Produce"} 1`)
+
+	// Shutting down exports the traces.
+	require.NoError(t, a.Shutdown())
+	b, err = os.ReadFile(traceFile)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"Name":"/log.v1.Log/Produce"`)
+}
+
+// TestAgentServerFails tests that the agent shuts down and reports
+// the error when a server fails.
+func TestAgentServerFails(t *testing.T) {
+	dir, err := os.MkdirTemp("", "agent-fail-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := New(Config{
+		DataDir:  dir,
+		GRPCAddr: "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+	})
+	require.NoError(t, err)
+
+	// The gRPC server fails once it can't accept connections.
+	require.NoError(t, a.grpcLn.Close())
+	select {
+	case <-a.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent didn't shut down")
+	}
+	require.Error(t, a.Err())
+	_, err = a.log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, log.ErrClosed, err)
+
+	// Shutting down the agent which has shut down changes nothing.
+	require.NoError(t, a.Shutdown())
+	require.Error(t, a.Err())
+}
+
+// TestAgentRepairs tests that the agent logs what was repaired in the log.
+func TestAgentRepairs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "agent-repair-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Leave zeros after the records, as a crash can.
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	_, err = clog.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, clog.Close())
+	f, err := os.OpenFile(filepath.Join(dir, "0.store"), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 24))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	core, logs := zapobserver.New(zapcore.InfoLevel)
+	a, err := New(Config{
+		DataDir:  dir,
+		GRPCAddr: "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		Logger:   zap.New(core),
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+
+	repairs := logs.FilterMessage("repaired segment").AllUntimed()
+	require.Len(t, repairs, 1)
+	require.Equal(t, zapcore.WarnLevel, repairs[0].Level)
+	require.Equal(t, uint64(0), repairs[0].ContextMap()["base_offset"])
+	require.Equal(t, uint64(24), repairs[0].ContextMap()["truncated_bytes"])
+}
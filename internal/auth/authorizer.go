@@ -0,0 +1,86 @@
+// Package auth decides which clients may do what to the log.
+package auth
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Wildcard matches any subject or action in a policy. It doesn't match
+// the empty subject of anonymous clients, which are denied everything.
+const Wildcard = "*"
+
+// Authorizer permits the actions of the subjects listed in a policy file.
+// Each line of the file permits a subject, such as the common name of
+// a client certificate, to perform an action:
+//
+//	# subject, action
+//	p, root, *
+//	p, producer, produce
+//	p, *, consume
+//
+// Anything which isn't permitted is denied, including anything done by
+// anonymous clients, which have no subject to match.
+type Authorizer struct {
+	policies map[string]map[string]bool // subject -> action -> permitted
+}
+
+// New loads the policy file of an Authorizer.
+func New(policyFile string) (*Authorizer, error) {
+	f, err := os.Open(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f, policyFile)
+}
+
+func parse(r io.Reader, name string) (*Authorizer, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	a := &Authorizer{policies: make(map[string]map[string]bool)}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("auth: %s: %w", name, err)
+		}
+		line, _ := cr.FieldPos(0)
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+		if len(record) != 3 || record[0] != "p" || record[1] == "" || record[2] == "" {
+			return nil, fmt.Errorf("auth: %s:%d: want a policy such as \"p, subject, action\"", name, line)
+		}
+		subject, action := record[1], record[2]
+		if a.policies[subject] == nil {
+			a.policies[subject] = make(map[string]bool)
+		}
+		a.policies[subject][action] = true
+	}
+}
+
+// Authorize returns nil if the subject may perform the action,
+// or a codes.PermissionDenied error otherwise.
+func (a *Authorizer) Authorize(subject, action string) error {
+	if subject == "" {
+		return status.Errorf(codes.PermissionDenied, "anonymous clients are not permitted to %s", action)
+	}
+	for _, s := range []string{subject, Wildcard} {
+		if a.policies[s][action] || a.policies[s][Wildcard] {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "%q is not permitted to %s", subject, action)
+}
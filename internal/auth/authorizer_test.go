@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorizer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "auth-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.csv")
+	require.NoError(t, os.WriteFile(policyFile, []byte(`
+# subject, action
+p, root, *
+p, producer, produce
+p, *, consume
+`), 0600))
+	a, err := New(policyFile)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		subject, action string
+		permitted       bool
+	}{
+		{"root", "produce", true},
+		{"root", "consume", true},
+		{"producer", "produce", true},
+		{"producer", "consume", true},
+		{"nobody", "consume", true},
+		{"nobody", "produce", false},
+		// The wildcard doesn't match anonymous clients.
+		{"", "produce", false},
+		{"", "consume", false},
+	} {
+		err := a.Authorize(tc.subject, tc.action)
+		if tc.permitted {
+			require.NoError(t, err, "%s %s", tc.subject, tc.action)
+			continue
+		}
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+		require.Contains(t, err.Error(), tc.subject)
+	}
+}
+
+func TestAuthorizerInvalidPolicy(t *testing.T) {
+	for _, policy := range []string{
+		"p, root\n",
+		"g, root, admin\n",
+		"p, root, produce\np, , consume\n",
+	} {
+		_, err := parse(strings.NewReader(policy), "policy.csv")
+		require.ErrorContains(t, err, "policy.csv:", policy)
+	}
+}
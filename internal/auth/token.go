@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for a bearer token which is unknown,
+// malformed, badly signed or expired.
+var ErrInvalidToken = errors.New("auth: invalid token")
+
+// Tokens maps static bearer tokens to their subjects, as listed
+// in a tokens file:
+//
+//	# token, subject
+//	3f9a0c51e2d4b7a6, root
+//	8b1e6d2c4a7f9053, reader
+type Tokens struct {
+	subjects map[string]string // token -> subject
+}
+
+// LoadTokens loads a tokens file.
+func LoadTokens(tokensFile string) (*Tokens, error) {
+	f, err := os.Open(tokensFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseTokens(f, tokensFile)
+}
+
+func parseTokens(r io.Reader, name string) (*Tokens, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	t := &Tokens{subjects: make(map[string]string)}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("auth: %s: %w", name, err)
+		}
+		line, _ := cr.FieldPos(0)
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+		if len(record) != 2 || record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("auth: %s:%d: want a token such as \"token, subject\"", name, line)
+		}
+		t.subjects[record[0]] = record[1]
+	}
+}
+
+// Verify returns the subject of the token.
+func (t *Tokens) Verify(token string) (string, error) {
+	// Compare every token in constant time rather than looking it up,
+	// so that the time taken doesn't tell how close a guess is.
+	var subject string
+	for known, s := range t.subjects {
+		if hmac.Equal([]byte(known), []byte(token)) {
+			subject = s
+		}
+	}
+	if subject == "" {
+		return "", ErrInvalidToken
+	}
+	return subject, nil
+}
+
+// JWTVerifier verifies JSON Web Tokens signed with HMAC-SHA256 (HS256).
+// The subject of a token is its "sub" claim. Tokens with an "exp" claim
+// in the past or an "nbf" claim in the future are rejected.
+type JWTVerifier struct {
+	key []byte
+	now func() time.Time
+}
+
+// NewJWTVerifier loads the signing key of the tokens from keyFile.
+// Surrounding whitespace in the file is ignored.
+func NewJWTVerifier(keyFile string) (*JWTVerifier, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("auth: %s: empty key", keyFile)
+	}
+	return &JWTVerifier{key: key, now: time.Now}, nil
+}
+
+// Verify returns the subject of the token.
+func (v *JWTVerifier) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", ErrInvalidToken
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+		Exp *int64 `json:"exp"`
+		Nbf *int64 `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.Sub == "" {
+		return "", ErrInvalidToken
+	}
+	now := v.now().Unix()
+	if claims.Exp != nil && now >= *claims.Exp {
+		return "", ErrInvalidToken
+	}
+	if claims.Nbf != nil && now < *claims.Nbf {
+		return "", ErrInvalidToken
+	}
+	return claims.Sub, nil
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a token.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
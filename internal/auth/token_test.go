@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	tokens, err := parseTokens(strings.NewReader("# token, subject\nsecret, root\nother, reader\n"), "tokens.csv")
+	require.NoError(t, err)
+
+	subject, err := tokens.Verify("secret")
+	require.NoError(t, err)
+	require.Equal(t, "root", subject)
+	_, err = tokens.Verify("guess")
+	require.Equal(t, ErrInvalidToken, err)
+	_, err = tokens.Verify("")
+	require.Equal(t, ErrInvalidToken, err)
+
+	_, err = parseTokens(strings.NewReader("secret\n"), "tokens.csv")
+	require.ErrorContains(t, err, "tokens.csv:1")
+}
+
+func TestJWTVerifier(t *testing.T) {
+	dir, err := os.MkdirTemp("", "jwt-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "jwt.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("signing key\n"), 0600))
+	v, err := NewJWTVerifier(keyFile)
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	v.now = func() time.Time { return now }
+
+	header := `{"alg":"HS256","typ":"JWT"}`
+	for _, tc := range []struct {
+		name    string
+		token   string
+		subject string
+	}{
+		{"valid", signJWT(header, `{"sub":"root"}`, "signing key"), "root"},
+		{"not expired", signJWT(header, `{"sub":"root","exp":1700000001}`, "signing key"), "root"},
+		{"expired", signJWT(header, `{"sub":"root","exp":1700000000}`, "signing key"), ""},
+		{"not yet valid", signJWT(header, `{"sub":"root","nbf":1700000001}`, "signing key"), ""},
+		{"other key", signJWT(header, `{"sub":"root"}`, "other key"), ""},
+		{"other algorithm", signJWT(`{"alg":"none"}`, `{"sub":"root"}`, "signing key"), ""},
+		{"no subject", signJWT(header, `{}`, "signing key"), ""},
+		{"malformed", "root", ""},
+	} {
+		subject, err := v.Verify(tc.token)
+		if tc.subject == "" {
+			require.Equal(t, ErrInvalidToken, err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.subject, subject, tc.name)
+	}
+}
+
+// signJWT returns a token of the header and the claims signed with key.
+func signJWT(header, claims, key string) string {
+	enc := base64.RawURLEncoding
+	s := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(s))
+	return s + "." + enc.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,375 @@
+package config
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sota0121/proglog/internal/agent"
+	"github.com/sota0121/proglog/internal/log"
+	"github.com/sota0121/proglog/internal/server"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the names of the environment variables of the settings.
+const envPrefix = "PROGLOG_"
+
+// Config is the configuration of the server daemon, as written in its
+// YAML file. Each setting can be overridden by an environment variable
+// and a command-line flag named after it, e.g. segment.max_store_bytes by
+// PROGLOG_SEGMENT_MAX_STORE_BYTES and -segment-max-store-bytes.
+// Zero values of the commit log settings select the defaults of the log.
+type Config struct {
+	DataDir  string `yaml:"data_dir"`
+	GRPCAddr string `yaml:"grpc_addr"`
+	HTTPAddr string `yaml:"http_addr"`
+	// ShutdownTimeout bounds how long in-flight requests may take
+	// when the daemon shuts down. 0 selects the default.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	Segment struct {
+		MaxStoreBytes uint64    `yaml:"max_store_bytes"`
+		MaxIndexBytes uint64    `yaml:"max_index_bytes"`
+		InitialOffset uint64    `yaml:"initial_offset"`
+		Codec         log.Codec `yaml:"codec"`
+	} `yaml:"segment"`
+	Sync struct {
+		Policy   log.SyncPolicy `yaml:"policy"`
+		Records  uint64         `yaml:"records"`
+		Interval time.Duration  `yaml:"interval"`
+	} `yaml:"sync"`
+	Retention struct {
+		MaxAge        time.Duration `yaml:"max_age"`
+		MaxBytes      uint64        `yaml:"max_bytes"`
+		CheckInterval time.Duration `yaml:"check_interval"`
+	} `yaml:"retention"`
+	Compaction struct {
+		Interval           time.Duration `yaml:"interval"`
+		TombstoneRetention time.Duration `yaml:"tombstone_retention"`
+	} `yaml:"compaction"`
+	TLS struct {
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+		CAFile   string `yaml:"ca_file"`
+	} `yaml:"tls"`
+	Auth struct {
+		PolicyFile string `yaml:"policy_file"`
+		TokensFile string `yaml:"tokens_file"`
+		JWTKeyFile string `yaml:"jwt_key_file"`
+	} `yaml:"auth"`
+	Observability struct {
+		LogRequests bool   `yaml:"log_requests"`
+		MetricsAddr string `yaml:"metrics_addr"`
+		TraceFile   string `yaml:"trace_file"`
+	} `yaml:"observability"`
+}
+
+// Default returns the configuration used for the settings which
+// are not set anywhere.
+func Default() Config {
+	var c Config
+	c.DataDir = "data"
+	c.GRPCAddr = ":8400"
+	c.HTTPAddr = ":8080"
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	return c
+}
+
+// Load builds the configuration from the defaults, the YAML file given by
+// the -config flag or PROGLOG_CONFIG, the environment variables and the
+// command-line flags, each overriding the previous ones, and validates it.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	// Parse the flags aside, so that they can be applied last.
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := fs.String("config", getenv(envPrefix+"CONFIG"), "path of the YAML config file")
+	parsed := Default()
+	for _, s := range parsed.settings() {
+		fs.Var(s.value, flagName(s.name), s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	settings := c.settings()
+	for _, s := range settings {
+		v := getenv(envName(s.name))
+		if v == "" {
+			continue
+		}
+		if err := s.value.Set(v); err != nil {
+			return nil, fmt.Errorf("config: %s: %w", envName(s.name), err)
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if err == nil && flagName(s.name) == f.Name {
+				if serr := s.value.Set(f.Value.String()); serr != nil {
+					err = fmt.Errorf("config: -%s: %w", f.Name, serr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// loadFile overrides the configuration with the settings of the YAML file.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	// Report misspelled settings instead of ignoring them.
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+// FieldError reports an invalid setting by its name in the YAML file.
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("config: %s %s", e.Field, e.Reason)
+}
+
+// Validate returns a *FieldError for the first invalid setting.
+func (c *Config) Validate() error {
+	if c.DataDir == "" {
+		return &FieldError{"data_dir", "must be set"}
+	}
+	for _, addr := range []struct{ field, addr string }{
+		{"grpc_addr", c.GRPCAddr},
+		{"http_addr", c.HTTPAddr},
+	} {
+		if _, _, err := net.SplitHostPort(addr.addr); err != nil {
+			return &FieldError{addr.field, fmt.Sprintf("must be a host:port address: %v", err)}
+		}
+	}
+	if c.GRPCAddr == c.HTTPAddr {
+		return &FieldError{"http_addr", "must differ from grpc_addr"}
+	}
+	if addr := c.Observability.MetricsAddr; addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return &FieldError{"observability.metrics_addr", fmt.Sprintf("must be a host:port address: %v", err)}
+		}
+		if addr == c.GRPCAddr || addr == c.HTTPAddr {
+			return &FieldError{"observability.metrics_addr", "must differ from grpc_addr and http_addr"}
+		}
+	}
+	// An index which can't hold a single entry makes every append fail.
+	if c.Segment.MaxIndexBytes != 0 && c.Segment.MaxIndexBytes < 12 {
+		return &FieldError{"segment.max_index_bytes", "must be at least 12 bytes to hold an index entry"}
+	}
+	for _, d := range []struct {
+		field string
+		d     time.Duration
+	}{
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"sync.interval", c.Sync.Interval},
+		{"retention.max_age", c.Retention.MaxAge},
+		{"retention.check_interval", c.Retention.CheckInterval},
+		{"compaction.interval", c.Compaction.Interval},
+		{"compaction.tombstone_retention", c.Compaction.TombstoneRetention},
+	} {
+		if d.d < 0 {
+			return &FieldError{d.field, "must not be negative"}
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return &FieldError{"tls", "needs both cert_file and key_file"}
+	}
+	if c.TLS.CAFile != "" && c.TLS.CertFile == "" {
+		return &FieldError{"tls.ca_file", "needs cert_file and key_file"}
+	}
+	if c.Auth.TokensFile != "" && c.Auth.JWTKeyFile != "" {
+		return &FieldError{"auth", "needs at most one of tokens_file and jwt_key_file"}
+	}
+	for _, file := range []struct{ field, path string }{
+		{"tls.cert_file", c.TLS.CertFile},
+		{"tls.key_file", c.TLS.KeyFile},
+		{"tls.ca_file", c.TLS.CAFile},
+		{"auth.policy_file", c.Auth.PolicyFile},
+		{"auth.tokens_file", c.Auth.TokensFile},
+		{"auth.jwt_key_file", c.Auth.JWTKeyFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			return &FieldError{file.field, fmt.Sprintf("must be a readable file: %v", err)}
+		}
+	}
+	return nil
+}
+
+// Agent returns the configuration of the agent which runs the daemon.
+func (c *Config) Agent() agent.Config {
+	a := agent.Config{
+		DataDir:  c.DataDir,
+		GRPCAddr: c.GRPCAddr,
+		HTTPAddr: c.HTTPAddr,
+	}
+	a.ShutdownTimeout = c.ShutdownTimeout
+	a.Log.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	a.Log.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	a.Log.Segment.InitialOffset = c.Segment.InitialOffset
+	a.Log.Segment.Codec = c.Segment.Codec
+	a.Log.Sync.Policy = c.Sync.Policy
+	a.Log.Sync.Records = c.Sync.Records
+	a.Log.Sync.Interval = c.Sync.Interval
+	a.Log.Retention.MaxAge = c.Retention.MaxAge
+	a.Log.Retention.MaxBytes = c.Retention.MaxBytes
+	a.Log.Retention.CheckInterval = c.Retention.CheckInterval
+	a.Log.Compaction.Interval = c.Compaction.Interval
+	a.Log.Compaction.TombstoneRetention = c.Compaction.TombstoneRetention
+	if c.TLS.CertFile != "" {
+		a.TLS = &server.TLSConfig{
+			CertFile:     c.TLS.CertFile,
+			KeyFile:      c.TLS.KeyFile,
+			ClientCAFile: c.TLS.CAFile,
+		}
+	}
+	a.PolicyFile = c.Auth.PolicyFile
+	a.TokensFile = c.Auth.TokensFile
+	a.JWTKeyFile = c.Auth.JWTKeyFile
+	a.LogRequests = c.Observability.LogRequests
+	a.MetricsAddr = c.Observability.MetricsAddr
+	a.TraceFile = c.Observability.TraceFile
+	return a
+}
+
+// setting is a value of the configuration which can be overridden.
+type setting struct {
+	name  string // name in the YAML file, e.g. segment.max_store_bytes
+	value flag.Value
+	usage string
+}
+
+// settings returns the settings of the configuration.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"data_dir", (*stringValue)(&c.DataDir), "directory of the commit log"},
+		{"grpc_addr", (*stringValue)(&c.GRPCAddr), "address of the gRPC server"},
+		{"http_addr", (*stringValue)(&c.HTTPAddr), "address of the JSON API"},
+		{"shutdown_timeout", (*durationValue)(&c.ShutdownTimeout), "how long in-flight requests may take when shutting down"},
+		{"segment.max_store_bytes", (*uint64Value)(&c.Segment.MaxStoreBytes), "maximum bytes of a segment's store"},
+		{"segment.max_index_bytes", (*uint64Value)(&c.Segment.MaxIndexBytes), "maximum bytes of a segment's index"},
+		{"segment.initial_offset", (*uint64Value)(&c.Segment.InitialOffset), "offset of the first record of a new log"},
+		{"segment.codec", textValue{&c.Segment.Codec}, "compression of record batches: none, gzip, snappy or zstd"},
+		{"sync.policy", textValue{&c.Sync.Policy}, "when records are synced: os, every-record, every-n or interval"},
+		{"sync.records", (*uint64Value)(&c.Sync.Records), "records between syncs with the every-n policy"},
+		{"sync.interval", (*durationValue)(&c.Sync.Interval), "time between syncs with the interval policy"},
+		{"retention.max_age", (*durationValue)(&c.Retention.MaxAge), "remove segments older than this; 0 keeps them"},
+		{"retention.max_bytes", (*uint64Value)(&c.Retention.MaxBytes), "remove the oldest segments over this size; 0 means no limit"},
+		{"retention.check_interval", (*durationValue)(&c.Retention.CheckInterval), "time between retention checks"},
+		{"compaction.interval", (*durationValue)(&c.Compaction.Interval), "time between compactions; 0 disables them"},
+		{"compaction.tombstone_retention", (*durationValue)(&c.Compaction.TombstoneRetention), "how long compaction keeps tombstones"},
+		{"tls.cert_file", (*stringValue)(&c.TLS.CertFile), "certificate file of the servers"},
+		{"tls.key_file", (*stringValue)(&c.TLS.KeyFile), "private key file of the servers"},
+		{"tls.ca_file", (*stringValue)(&c.TLS.CAFile), "CA file to verify client certificates with"},
+		{"auth.policy_file", (*stringValue)(&c.Auth.PolicyFile), "file of the policies which permit clients to produce and consume"},
+		{"auth.tokens_file", (*stringValue)(&c.Auth.TokensFile), "file of the bearer tokens of the JSON API"},
+		{"auth.jwt_key_file", (*stringValue)(&c.Auth.JWTKeyFile), "HMAC key file to verify the JWT bearer tokens of the JSON API with"},
+		{"observability.log_requests", (*boolValue)(&c.Observability.LogRequests), "log every gRPC request to stderr"},
+		{"observability.metrics_addr", (*stringValue)(&c.Observability.MetricsAddr), "address to serve Prometheus metrics at /metrics on"},
+		{"observability.trace_file", (*stringValue)(&c.Observability.TraceFile), "file to export the traces of the gRPC requests to, or - for stdout"},
+	}
+}
+
+// flagName returns the command-line flag of a setting.
+func flagName(name string) string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(name)
+}
+
+// envName returns the environment variable of a setting.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, ".", "_"))
+}
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type boolValue bool
+
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.New("must be true or false")
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+type uint64Value uint64
+
+func (v *uint64Value) String() string { return strconv.FormatUint(uint64(*v), 10) }
+func (v *uint64Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return errors.New("must be a non-negative integer")
+	}
+	*v = uint64Value(n)
+	return nil
+}
+
+type durationValue time.Duration
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.New("must be a duration such as 30s or 1h")
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+// textValue adapts the settings with a text form, such as log.Codec.
+type textValue struct {
+	v interface {
+		encoding.TextMarshaler
+		encoding.TextUnmarshaler
+	}
+}
+
+func (v textValue) String() string {
+	if v.v == nil {
+		return ""
+	}
+	b, _ := v.v.MarshalText()
+	return string(b)
+}
+func (v textValue) Set(s string) error { return v.v.UnmarshalText([]byte(s)) }
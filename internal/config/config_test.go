@@ -0,0 +1,131 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sota0121/proglog/internal/log"
+	"github.com/sota0121/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig(t *testing.T) {
+	testMap := map[string]func(t *testing.T, path string){
+		"file, environment and flags override in order": testLoadPrecedence,
+		"invalid settings are named":                    testLoadInvalid,
+		"misspelled settings are rejected":              testLoadUnknownField,
+		"tls and auth files are passed to the servers":  testLoadTLS,
+	}
+
+	for scenario, fn := range testMap {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "config-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, filepath.Join(dir, "config.yaml"))
+		})
+	}
+}
+
+// env returns a getenv function which looks the variables up in vars.
+func env(vars map[string]string) func(string) string {
+	return func(key string) string {
+		return vars[key]
+	}
+}
+
+func testLoadPrecedence(t *testing.T, path string) {
+	require.NoError(t, os.WriteFile(path, []byte(`
+data_dir: /var/lib/proglog
+grpc_addr: ":9400"
+segment:
+  max_store_bytes: 4096
+  codec: zstd
+sync:
+  policy: every-n
+  records: 100
+retention:
+  max_age: 168h
+observability:
+  trace_file: traces.json
+`), 0600))
+
+	c, err := Load(
+		[]string{"-config", path, "-grpc-addr", ":9500", "-retention-max-age", "24h", "-observability-log-requests"},
+		env(map[string]string{
+			"PROGLOG_GRPC_ADDR":               ":9600",
+			"PROGLOG_SEGMENT_MAX_STORE_BYTES": "8192",
+		}),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/proglog", c.DataDir) // file
+	require.Equal(t, ":9500", c.GRPCAddr)           // flag over environment and file
+	require.Equal(t, ":8080", c.HTTPAddr)           // default
+	require.Equal(t, uint64(8192), c.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(1<<20), c.Segment.MaxIndexBytes) // default
+	require.Equal(t, 24*time.Hour, c.Retention.MaxAge)
+
+	a := c.Agent()
+	require.Equal(t, log.CodecZstd, a.Log.Segment.Codec)
+	require.Equal(t, log.SyncEveryN, a.Log.Sync.Policy)
+	require.Equal(t, uint64(100), a.Log.Sync.Records)
+	require.Nil(t, a.TLS)
+	require.True(t, a.LogRequests)
+	require.Equal(t, "traces.json", a.TraceFile)
+}
+
+func testLoadInvalid(t *testing.T, path string) {
+	_, err := Load([]string{"-http-addr", ":8400"}, env(nil))
+	require.Equal(t, &FieldError{"http_addr", "must differ from grpc_addr"}, err)
+
+	_, err = Load(nil, env(map[string]string{"PROGLOG_SEGMENT_MAX_INDEX_BYTES": "4"}))
+	require.Equal(t, "segment.max_index_bytes", err.(*FieldError).Field)
+
+	_, err = Load([]string{"-tls-cert-file", path}, env(nil))
+	require.Equal(t, &FieldError{"tls", "needs both cert_file and key_file"}, err)
+
+	_, err = Load([]string{"-tls-ca-file", path}, env(nil))
+	require.Equal(t, &FieldError{"tls.ca_file", "needs cert_file and key_file"}, err)
+
+	_, err = Load([]string{"-observability-metrics-addr", ":8080"}, env(nil))
+	require.Equal(t, &FieldError{"observability.metrics_addr", "must differ from grpc_addr and http_addr"}, err)
+
+	_, err = Load([]string{"-sync-policy", "sometimes"}, env(nil))
+	require.ErrorContains(t, err, "-sync-policy")
+}
+
+func testLoadTLS(t *testing.T, path string) {
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+
+	c, err := Load([]string{
+		"-tls-cert-file", path,
+		"-tls-key-file", path,
+		"-tls-ca-file", path,
+		"-auth-policy-file", path,
+		"-auth-tokens-file", path,
+	}, env(nil))
+	require.NoError(t, err)
+	require.Equal(t, &server.TLSConfig{
+		CertFile:     path,
+		KeyFile:      path,
+		ClientCAFile: path,
+	}, c.Agent().TLS)
+	require.Equal(t, path, c.Agent().PolicyFile)
+	require.Equal(t, path, c.Agent().TokensFile)
+
+	_, err = Load([]string{
+		"-auth-tokens-file", path,
+		"-auth-jwt-key-file", path,
+	}, env(nil))
+	require.Equal(t, &FieldError{"auth", "needs at most one of tokens_file and jwt_key_file"}, err)
+}
+
+func testLoadUnknownField(t *testing.T, path string) {
+	require.NoError(t, os.WriteFile(path, []byte("segment:\n  max_store_byte: 10\n"), 0600))
+
+	_, err := Load(nil, env(map[string]string{"PROGLOG_CONFIG": path}))
+	require.ErrorContains(t, err, "max_store_byte")
+}
@@ -0,0 +1,131 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	api "github.com/sota0121/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Each store frame holds a batch of consecutive records which share the
+// frame's header and checksum. The payload of a frame is
+// [batchMagic][codec][records], where the records, once decompressed,
+// are a sequence of [length][marshaled record].
+const (
+	batchMagic       byte = 0xff
+	batchHeaderWidth      = 2 // bytes
+	recLenWidth           = 4 // bytes
+)
+
+var (
+	// The zstd coders are safe for concurrent use with EncodeAll and
+	// DecodeAll. They only fail to be created with invalid options.
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// encodeBatch marshals the records into the payload of a frame,
+// compressing them with the given codec. Records which the codec doesn't
+// shrink, such as most single small records, are stored with CodecNone.
+func encodeBatch(records []*api.Record, codec Codec) ([]byte, error) {
+	var raw []byte
+	for _, record := range records {
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		var l [recLenWidth]byte
+		enc.PutUint32(l[:], uint32(len(p)))
+		raw = append(raw, l[:]...)
+		raw = append(raw, p...)
+	}
+	compressed, err := compress(codec, raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(raw) {
+		codec, compressed = CodecNone, raw
+	}
+	return append([]byte{batchMagic, byte(codec)}, compressed...), nil
+}
+
+// decodeBatch unmarshals the records in the payload of a frame.
+// It returns errCorruptFrame if the payload can't be decoded.
+func decodeBatch(p []byte) ([]*api.Record, error) {
+	if len(p) < batchHeaderWidth || p[0] != batchMagic {
+		return nil, errCorruptFrame
+	}
+	raw, err := decompress(Codec(p[1]), p[batchHeaderWidth:])
+	if err != nil {
+		return nil, errCorruptFrame
+	}
+	var records []*api.Record
+	for len(raw) > 0 {
+		if len(raw) < recLenWidth {
+			return nil, errCorruptFrame
+		}
+		size := uint64(enc.Uint32(raw))
+		raw = raw[recLenWidth:]
+		if size > uint64(len(raw)) {
+			return nil, errCorruptFrame
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(raw[:size], record); err != nil {
+			return nil, errCorruptFrame
+		}
+		records = append(records, record)
+		raw = raw[size:]
+	}
+	if len(records) == 0 {
+		return nil, errCorruptFrame
+	}
+	return records, nil
+}
+
+// compress compresses p with the given codec.
+func compress(codec Codec, p []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, p), nil
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(p, nil), nil
+	}
+	return nil, fmt.Errorf("log: unknown codec %d", codec)
+}
+
+// decompress reverses compress.
+func decompress(codec Codec, p []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case CodecSnappy:
+		return snappy.Decode(nil, p)
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(p, nil)
+	}
+	return nil, fmt.Errorf("log: unknown codec %d", codec)
+}
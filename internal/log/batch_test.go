@@ -0,0 +1,127 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/sota0121/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestBatch(t *testing.T) {
+	testMap := map[string]func(t *testing.T, codec Codec){
+		"batch round trips":          testBatchRoundTrip,
+		"segment reads batched data": testBatchSegment,
+	}
+
+	codecs := map[string]Codec{
+		"none":   CodecNone,
+		"gzip":   CodecGzip,
+		"snappy": CodecSnappy,
+		"zstd":   CodecZstd,
+	}
+	for scenario, fn := range testMap {
+		for name, codec := range codecs {
+			t.Run(scenario+" with "+name, func(t *testing.T) {
+				fn(t, codec)
+			})
+		}
+	}
+}
+
+// stampedRecords returns n records with consecutive offsets from base,
+// as the segment stamps them.
+func stampedRecords(base uint64, n int) []*api.Record {
+	records := make([]*api.Record, n)
+	for i := range records {
+		records[i] = &api.Record{
+			Value:     []byte(`{"event": "hello world"}`),
+			Offset:    base + uint64(i),
+			Timestamp: timestamppb.New(time.Now()),
+		}
+	}
+	return records
+}
+
+func testBatchRoundTrip(t *testing.T, codec Codec) {
+	want := stampedRecords(0, 100)
+	p, err := encodeBatch(want, codec)
+	require.NoError(t, err)
+	require.Equal(t, batchMagic, p[0])
+	require.Equal(t, byte(codec), p[1])
+
+	got, err := decodeBatch(p)
+	require.NoError(t, err)
+	require.Len(t, got, len(want))
+	for i := range want {
+		require.True(t, proto.Equal(want[i], got[i]))
+	}
+
+	// A single small record, which no codec shrinks, is stored uncompressed.
+	small, err := encodeBatch(stampedRecords(0, 1), codec)
+	require.NoError(t, err)
+	require.Equal(t, byte(CodecNone), small[1])
+	got, err = decodeBatch(small)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+
+	// A damaged batch is reported as corrupt.
+	_, err = decodeBatch(p[:len(p)-1])
+	require.Equal(t, errCorruptFrame, err)
+
+	// So are empty payloads and batches, which are never written.
+	_, err = decodeBatch(nil)
+	require.Equal(t, errCorruptFrame, err)
+	empty, err := encodeBatch(nil, codec)
+	require.NoError(t, err)
+	_, err = decodeBatch(empty)
+	require.Equal(t, errCorruptFrame, err)
+}
+
+func testBatchSegment(t *testing.T, codec Codec) {
+	dir, err := os.MkdirTemp("", "batch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.Codec = codec
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	// Every record of a batch can be read by its offset.
+	require.NoError(t, s.write(stampedRecords(0, 10)))
+	for off := uint64(0); off < 10; off++ {
+		record, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	require.NoError(t, s.Close())
+
+	// The batches are indexed the same way after reopening.
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.True(t, s.repair.empty())
+	require.Equal(t, uint64(11), s.nextOffset)
+	record, err := s.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), record.Offset)
+	require.NoError(t, s.Close())
+}
+
+// TestBatchUnframedRecord tests that a record which isn't in a batch,
+// as the stores of unsupported formats hold, is not decoded.
+func TestBatchUnframedRecord(t *testing.T) {
+	p, err := proto.Marshal(stampedRecords(3, 1)[0])
+	require.NoError(t, err)
+
+	_, err = decodeBatch(p)
+	require.Equal(t, errCorruptFrame, err)
+}
@@ -0,0 +1,54 @@
+package log
+
+import "sync"
+
+// groupCommit batches the syncs of concurrent appends.
+// The first waiter becomes the leader and syncs everything appended so far,
+// while later waiters queue up behind it. When the leader finishes, every
+// waiter whose record was covered by the sync is released, and one of the
+// others leads the next sync. A single flush and fsync thus commits the
+// records of many concurrent producers.
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool   // a leader is syncing
+	durable uint64 // every offset below durable is on stable storage
+	syncs   uint64 // number of syncs performed
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// wait blocks until the record with the given offset is durable.
+// sync persists the log and returns the offset up to which records are durable.
+func (g *groupCommit) wait(off uint64, sync func() (uint64, error)) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.durable <= off {
+		// Someone else is syncing, so wait for the result.
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		// Lead the next sync.
+		g.syncing = true
+		g.mu.Unlock()
+		durable, err := sync()
+		g.mu.Lock()
+		g.syncing = false
+		g.syncs++
+		if err == nil && durable > g.durable {
+			g.durable = durable
+		}
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
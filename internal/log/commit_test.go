@@ -0,0 +1,71 @@
+package log
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	g := newGroupCommit()
+
+	var appended uint64 = 1
+	started := make(chan struct{})
+	release := make(chan struct{})
+	first := true
+	syncFn := func() (uint64, error) {
+		durable := atomic.LoadUint64(&appended)
+		if first {
+			first = false
+			close(started)
+			<-release
+		}
+		return durable, nil
+	}
+
+	// The first waiter leads a sync which blocks.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		require.NoError(t, g.wait(0, syncFn))
+	}()
+	<-started
+
+	// Records appended in the meantime wait for the next sync.
+	var appends sync.WaitGroup
+	for i := 1; i < 10; i++ {
+		wg.Add(1)
+		appends.Add(1)
+		go func() {
+			defer wg.Done()
+			off := atomic.AddUint64(&appended, 1) - 1
+			appends.Done()
+			require.NoError(t, g.wait(off, syncFn))
+		}()
+	}
+	appends.Wait()
+	close(release)
+	wg.Wait()
+
+	// Every record was committed by two syncs.
+	require.Equal(t, uint64(2), g.syncs)
+	require.Equal(t, uint64(10), g.durable)
+}
+
+func TestGroupCommitError(t *testing.T) {
+	g := newGroupCommit()
+
+	want := errors.New("sync failed")
+	err := g.wait(0, func() (uint64, error) { return 1, want })
+	require.Equal(t, want, err)
+	require.Equal(t, uint64(0), g.durable)
+
+	// The next waiter retries the sync.
+	err = g.wait(0, func() (uint64, error) { return 1, nil })
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), g.durable)
+}
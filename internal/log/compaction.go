@@ -0,0 +1,155 @@
+package log
+
+import (
+	"os"
+	"time"
+
+	api "github.com/sota0121/proglog/api/v1"
+)
+
+// Compact rewrites the sealed segments of the log, keeping only the newest
+// record of each key. Records without a key are always kept.
+// A tombstone, the newest record of a deleted key, is kept until
+// Config.Compaction.TombstoneRetention has passed since it was appended,
+// so that consumers can see the deletion, and is removed afterwards.
+// The kept records keep their offsets, and Read reports the offsets
+// of the removed records with ErrOffsetCompacted.
+// The active segment is neither compacted nor consulted for newer keys.
+// Compact fails with ErrClosed once the log is closed.
+func (l *Log) Compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	// Sealed segments are immutable and only removed while holding
+	// compactMu, so they can be read without blocking appends.
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return ErrClosed
+	}
+	sealed := make([]*segment, len(l.segments)-1)
+	copy(sealed, l.segments)
+	l.mu.RUnlock()
+
+	// Find the offset of the newest record of each key.
+	latest := make(map[string]uint64)
+	for _, seg := range sealed {
+		if err := seg.scan(func(records []*api.Record) error {
+			for _, record := range records {
+				if len(record.Key) > 0 {
+					latest[string(record.Key)] = record.Offset
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Segments are compacted from the oldest, so a tombstone outlives
+	// the older records of its key even if compaction fails midway.
+	expired := time.Now().Add(-l.Config.Compaction.TombstoneRetention)
+	for _, seg := range sealed {
+		if err := l.compactSegment(seg, latest, expired); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactSegment rewrites the segment without the records superseded by
+// a newer record of the same key and without the tombstones appended before
+// expired, and swaps it into the log.
+func (l *Log) compactSegment(seg *segment, latest map[string]uint64, expired time.Time) error {
+	// Write the kept records to a new segment in a temporary directory.
+	dir, err := os.MkdirTemp(l.Dir, "compact-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	cleaned, err := newSegment(dir, seg.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	var removed int
+	err = seg.scan(func(records []*api.Record) error {
+		// The kept records of a batch stay together in a smaller batch.
+		var kept []*api.Record
+		for _, record := range records {
+			superseded := len(record.Key) > 0 && latest[string(record.Key)] != record.Offset
+			if superseded || (record.Tombstone && record.Timestamp.AsTime().Before(expired)) {
+				removed++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		if len(kept) == 0 {
+			return nil
+		}
+		return cleaned.write(kept)
+	})
+	if err == nil && removed > 0 {
+		err = cleaned.Sync()
+	}
+	if cerr := cleaned.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || removed == 0 {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Don't reopen the segment into a log which is closing.
+	if l.closed {
+		return ErrClosed
+	}
+	if err := seg.Close(); err != nil {
+		return err
+	}
+	// Remove the old indexes before replacing the store. If we crash
+	// in between, the indexes are rebuilt from whichever store is in place.
+	err = replaceSegmentFiles(l.Dir, seg, cleaned)
+
+	// Reopen the segment from whatever is on disk now.
+	s, oerr := newSegment(l.Dir, seg.baseOffset, l.Config)
+	if oerr != nil {
+		return oerr
+	}
+	for i := range l.segments {
+		if l.segments[i] == seg {
+			l.segments[i] = s
+		}
+	}
+	return err
+}
+
+// replaceSegmentFiles moves the files of the cleaned segment over the files
+// of the closed segment.
+func replaceSegmentFiles(dir string, seg, cleaned *segment) error {
+	if err := os.Remove(seg.index.Name()); err != nil {
+		return err
+	}
+	if err := os.Remove(seg.timeIndex.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(cleaned.store.Name(), seg.store.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(cleaned.index.Name(), seg.index.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(cleaned.timeIndex.Name(), seg.timeIndex.Name()); err != nil {
+		return err
+	}
+
+	// Persist the renames.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
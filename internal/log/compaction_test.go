@@ -0,0 +1,185 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/sota0121/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompaction(t *testing.T) {
+	testMap := map[string]func(t *testing.T, log *Log){
+		"only the newest record of each key is kept": testCompact,
+		"compacted log can be reopened":              testCompactReopen,
+		"compaction runs in the background":          testCompactBackground,
+		"tombstones are kept for their retention":    testCompactTombstone,
+		"compaction and close don't overlap":         testCompactClose,
+	}
+
+	for scenario, fn := range testMap {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "compaction-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = 3 * entWidth
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			// Fill two sealed segments and the active one.
+			for _, key := range []string{"a", "b", "", "a", "b", "a", "c"} {
+				_, err := log.Append(&api.Record{
+					Key:   []byte(key),
+					Value: []byte("hello world"),
+				})
+				require.NoError(t, err)
+			}
+			require.Len(t, log.segments, 3)
+
+			fn(t, log)
+		})
+	}
+}
+
+// requireCompacted checks that only the newest records of the keys
+// in the sealed segments and the records without a key are left.
+func requireCompacted(t *testing.T, log *Log) {
+	t.Helper()
+
+	for off := uint64(0); off < 7; off++ {
+		record, err := log.Read(off)
+		switch off {
+		case 0, 1, 3:
+			require.Equal(t, api.ErrOffsetCompacted{Offset: off}, err)
+		default:
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+		}
+	}
+}
+
+func testCompact(t *testing.T, log *Log) {
+	size := log.Size()
+	require.NoError(t, log.Compact())
+	requireCompacted(t, log)
+	require.Less(t, log.Size(), size)
+
+	// Compacting again changes nothing.
+	size = log.Size()
+	require.NoError(t, log.Compact())
+	requireCompacted(t, log)
+	require.Equal(t, size, log.Size())
+
+	// Range reads skip the compacted records.
+	records, err := log.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	var offsets []uint64
+	for _, record := range records {
+		offsets = append(offsets, record.Offset)
+	}
+	require.Equal(t, []uint64{2, 4, 5, 6}, offsets)
+
+	// Reads past the log still fail.
+	_, err = log.Read(7)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 7}, err)
+}
+
+func testCompactReopen(t *testing.T, log *Log) {
+	require.NoError(t, log.Compact())
+	require.NoError(t, log.Close())
+
+	log, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Repairs())
+	requireCompacted(t, log)
+
+	// The log keeps appending after the active segment.
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+}
+
+func testCompactBackground(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+
+	c := log.Config
+	c.Compaction.Interval = 10 * time.Millisecond
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Segments are compacted in order, so wait for the last one.
+	require.Eventually(t, func() bool {
+		_, err := log.Read(3)
+		return err == api.ErrOffsetCompacted{Offset: 3}
+	}, time.Second, c.Compaction.Interval)
+	requireCompacted(t, log)
+}
+
+func testCompactTombstone(t *testing.T, log *Log) {
+	// A tombstone can't carry a value.
+	require.Equal(t,
+		api.ErrInvalidRecord{Reason: "a tombstone needs a key and no value"},
+		appendTombstone(log, "a", []byte("hello world")),
+	)
+
+	// Delete key a and seal the tombstone with two more records.
+	_, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, appendTombstone(log, "a", nil))
+	for _, key := range []string{"d", "e"} {
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+
+	// The tombstone supersedes every older record of the key.
+	require.NoError(t, log.Compact())
+	for _, off := range []uint64{0, 3, 5, 7} {
+		_, err := log.Read(off)
+		require.Equal(t, api.ErrOffsetCompacted{Offset: off}, err)
+	}
+	record, err := log.Read(8)
+	require.NoError(t, err)
+	require.True(t, record.Tombstone)
+	require.Equal(t, []byte("a"), record.Key)
+
+	// The tombstone is removed once its retention has passed.
+	log.Config.Compaction.TombstoneRetention = time.Nanosecond
+	require.NoError(t, log.Compact())
+	_, err = log.Read(8)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: 8}, err)
+	record, err = log.Read(9)
+	require.NoError(t, err)
+	require.Equal(t, []byte("d"), record.Key)
+}
+
+func testCompactClose(t *testing.T, log *Log) {
+	// Close waits for a compaction which runs at the same time.
+	compacted := make(chan error)
+	go func() {
+		compacted <- log.Compact()
+	}()
+	require.NoError(t, log.Close())
+	if err := <-compacted; err != ErrClosed {
+		require.NoError(t, err)
+	}
+
+	// Compacting a closed log fails.
+	require.Equal(t, ErrClosed, log.Compact())
+}
+
+// appendTombstone appends a tombstone for key with the given value.
+func appendTombstone(log *Log, key string, value []byte) error {
+	_, err := log.Append(&api.Record{
+		Key:       []byte(key),
+		Value:     value,
+		Tombstone: true,
+	})
+	return err
+}
@@ -1,9 +1,123 @@
 package log
 
+import (
+	"fmt"
+	"time"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// TimeIndexIntervalBytes is the number of store bytes between
+		// the records indexed by append time.
+		TimeIndexIntervalBytes uint64
+		// Codec compresses the record batches written to the store.
+		Codec Codec
+	}
+	// Sync configures when appended records are persisted to disk.
+	Sync struct {
+		Policy   SyncPolicy
+		Records  uint64        // number of records between syncs with SyncEveryN
+		Interval time.Duration // time between syncs with SyncInterval
+	}
+	// Retention configures when old segments are removed.
+	// The active segment is never removed.
+	Retention struct {
+		MaxAge        time.Duration // remove segments whose newest record is older; 0 keeps them forever
+		MaxBytes      uint64        // remove the oldest segments while the log is larger; 0 means no limit
+		CheckInterval time.Duration // time between retention checks
+	}
+	// Compaction configures the background compaction of keyed records.
+	Compaction struct {
+		Interval           time.Duration // time between compactions; 0 disables background compaction
+		TombstoneRetention time.Duration // how long compaction keeps tombstones
+	}
+}
+
+// SyncPolicy determines when appended records are flushed and synced to disk,
+// trading append latency for durability.
+type SyncPolicy int
+
+const (
+	// SyncOS leaves flushing to the store buffer and the OS.
+	// Acknowledged records may be lost on crash.
+	SyncOS SyncPolicy = iota
+	// SyncEveryRecord syncs every record before Append returns.
+	SyncEveryRecord
+	// SyncEveryN syncs once every Sync.Records records.
+	SyncEveryN
+	// SyncInterval syncs in the background every Sync.Interval.
+	SyncInterval
+)
+
+var syncPolicyNames = []string{"os", "every-record", "every-n", "interval"}
+
+// String returns the name of the policy.
+func (p SyncPolicy) String() string {
+	if p < 0 || int(p) >= len(syncPolicyNames) {
+		return fmt.Sprintf("SyncPolicy(%d)", int(p))
+	}
+	return syncPolicyNames[p]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (p SyncPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *SyncPolicy) UnmarshalText(text []byte) error {
+	for i, name := range syncPolicyNames {
+		if string(text) == name {
+			*p = SyncPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sync policy %q, want one of %v", text, syncPolicyNames)
+}
+
+// Codec determines how the records of a batch are compressed in the store.
+// Every batch records its codec, so the codec can be changed at any time.
+// Each append is a batch of its own, so compression only pays off for
+// the batches of AppendBatch; batches which it wouldn't shrink are
+// stored uncompressed.
+type Codec uint8
+
+const (
+	// CodecNone stores the records uncompressed.
+	CodecNone Codec = iota
+	// CodecGzip compresses the records with gzip.
+	CodecGzip
+	// CodecSnappy compresses the records with snappy.
+	CodecSnappy
+	// CodecZstd compresses the records with zstd.
+	CodecZstd
+)
+
+var codecNames = []string{"none", "gzip", "snappy", "zstd"}
+
+// String returns the name of the codec.
+func (c Codec) String() string {
+	if int(c) >= len(codecNames) {
+		return fmt.Sprintf("Codec(%d)", int(c))
+	}
+	return codecNames[c]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (c Codec) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (c *Codec) UnmarshalText(text []byte) error {
+	for i, name := range codecNames {
+		if string(text) == name {
+			*c = Codec(i)
+			return nil
+		}
 	}
+	return fmt.Errorf("unknown codec %q, want one of %v", text, codecNames)
 }
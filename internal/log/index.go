@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -56,6 +57,10 @@ func (i *index) Close() error {
 	if err := i.file.Sync(); err != nil {
 		return err
 	}
+	// Release the mapping, so that the space of a removed index is freed.
+	if err := i.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
 	// Shrinks the file to the size of the data written.
 	if err := i.file.Truncate(int64(i.size)); err != nil {
 		return err
@@ -63,6 +68,11 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
+// Sync persists the memory-mapped entries to disk.
+func (i *index) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 // Read returns the position of the record with the given offset.
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	// Read the offset.
@@ -86,6 +96,17 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// Find returns the number of the first entry whose offset is at least
+// the given relative offset. Offsets may have gaps after compaction,
+// so the entries are searched by offset instead of being addressed by it.
+func (i *index) Find(off uint32) uint64 {
+	n := i.size / entWidth
+	return uint64(sort.Search(int(n), func(j int) bool {
+		out, _ := i.entry(uint64(j))
+		return out >= off
+	}))
+}
+
 // Write writes the offset and position of a record to the index.
 func (i *index) Write(off uint32, pos uint64) error {
 	// Check if the index contains enough space to write the entry.
@@ -103,6 +124,12 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// entry returns the raw offset and position of the n-th entry without bounds checking against the size.
+func (i *index) entry(n uint64) (off uint32, pos uint64) {
+	p := n * entWidth
+	return enc.Uint32(i.mmap[p : p+offWidth]), enc.Uint64(i.mmap[p+offWidth : p+entWidth])
+}
+
 func (i *index) isMaxed() bool {
 	return uint64(len(i.mmap)) < i.size+entWidth
 }
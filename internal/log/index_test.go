@@ -56,3 +56,35 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexFind(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_find_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+
+	// Offsets have gaps after compaction.
+	for i, off := range []uint32{0, 2, 3, 7} {
+		require.NoError(t, idx.Write(off, uint64(i*10)))
+	}
+
+	tests := []struct {
+		off  uint32
+		want uint64
+	}{
+		{off: 0, want: 0},
+		{off: 1, want: 1},
+		{off: 2, want: 1},
+		{off: 4, want: 3},
+		{off: 7, want: 3},
+		{off: 8, want: 4}, // past the last entry
+	}
+	for _, tc := range tests {
+		require.Equal(t, tc.want, idx.Find(tc.off), "find %d", tc.off)
+	}
+	require.NoError(t, idx.Close())
+}
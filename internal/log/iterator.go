@@ -0,0 +1,76 @@
+package log
+
+import (
+	"fmt"
+	"io"
+
+	api "github.com/sota0121/proglog/api/v1"
+)
+
+// iteratorReadAhead is the number of records an iterator reads at once.
+const iteratorReadAhead = 128
+
+// Iterator reads the records of a log in offset order across segments.
+// It isn't safe for concurrent use, but the log may be appended to,
+// compacted and truncated while it is being iterated.
+type Iterator struct {
+	log     *Log
+	next    uint64        // offset of the next record to read
+	records []*api.Record // records read ahead of Next
+}
+
+// ErrTruncated is returned by Iterator.Next when the records it was about
+// to read were removed from the log by retention or Truncate.
+type ErrTruncated struct {
+	Offset uint64 // offset of the next record of the iterator
+	Lowest uint64 // lowest offset left in the log
+}
+
+// Error implements the error interface.
+func (e ErrTruncated) Error() string {
+	return fmt.Sprintf(
+		"log: records from offset %d were removed, the log now begins at offset %d",
+		e.Offset, e.Lowest,
+	)
+}
+
+// NewIterator returns an iterator which begins at the given offset.
+func (l *Log) NewIterator(from uint64) *Iterator {
+	return &Iterator{log: l, next: from}
+}
+
+// Next returns the next record of the log. The offsets of compacted
+// records are skipped. At the end of the log it returns io.EOF, and
+// calling it again continues with the records appended in the meantime;
+// Log.Wait blocks until there are any.
+func (it *Iterator) Next() (*api.Record, error) {
+	if len(it.records) == 0 {
+		records, err := it.log.ReadRange(it.next, iteratorReadAhead, 0)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			lowest, err := it.log.LowestOffset()
+			if err != nil {
+				return nil, err
+			}
+			if it.next < lowest {
+				return nil, ErrTruncated{Offset: it.next, Lowest: lowest}
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, io.EOF
+		}
+		it.records = records
+	}
+	record := it.records[0]
+	it.records = it.records[1:]
+	it.next = record.Offset + 1
+	return record, nil
+}
+
+// Offset returns the offset from which the iterator reads next.
+func (it *Iterator) Offset() uint64 {
+	return it.next
+}
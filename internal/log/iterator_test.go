@@ -0,0 +1,119 @@
+package log
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	api "github.com/sota0121/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	testMap := map[string]func(t *testing.T, log *Log){
+		"records are read in order across segments": testIterate,
+		"appends are picked up after the end":       testIterateAppends,
+		"truncated records are reported":            testIterateTruncated,
+		"concurrent appends are read":               testIterateConcurrently,
+	}
+
+	for scenario, fn := range testMap {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "iterator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = 3 * entWidth
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fn(t, log)
+		})
+	}
+}
+
+// appendValues appends n records to the log.
+func appendValues(t *testing.T, log *Log, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+}
+
+func testIterate(t *testing.T, log *Log) {
+	appendValues(t, log, 10)
+	require.Len(t, log.segments, 4)
+
+	it := log.NewIterator(2)
+	for off := uint64(2); off < 10; off++ {
+		record, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	_, err := it.Next()
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, uint64(10), it.Offset())
+}
+
+func testIterateAppends(t *testing.T, log *Log) {
+	it := log.NewIterator(0)
+	_, err := it.Next()
+	require.Equal(t, io.EOF, err)
+
+	appendValues(t, log, 2)
+	for off := uint64(0); off < 2; off++ {
+		record, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func testIterateTruncated(t *testing.T, log *Log) {
+	appendValues(t, log, 7)
+	it := log.NewIterator(0)
+	for off := uint64(0); off < 7; off++ {
+		_, err := it.Next()
+		require.NoError(t, err)
+	}
+
+	// Remove the records the iterator would read next.
+	appendValues(t, log, 3)
+	require.NoError(t, log.Truncate(8))
+	_, err := it.Next()
+	require.Equal(t, ErrTruncated{Offset: 7, Lowest: 9}, err)
+
+	// The iterator can't skip the removed records.
+	_, err = it.Next()
+	require.Equal(t, ErrTruncated{Offset: 7, Lowest: 9}, err)
+}
+
+func testIterateConcurrently(t *testing.T, log *Log) {
+	const n = 100
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			if _, err := log.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+				return
+			}
+		}
+	}()
+
+	it := log.NewIterator(0)
+	for off := uint64(0); off < n; {
+		record, err := it.Next()
+		if err == io.EOF {
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		off++
+	}
+	<-done
+}
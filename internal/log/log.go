@@ -1,30 +1,71 @@
 package log
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/sota0121/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrClosed is returned when the log is used after it was closed.
+var ErrClosed = errors.New("log: closed")
+
+// ErrUnsupportedFormat is returned by NewLog for a directory of segments
+// which the log can't read, such as the ones written before records were
+// checksummed. Their records must be copied into a new log by the version
+// which wrote them.
+var ErrUnsupportedFormat = errors.New("log: unsupported segment format")
+
+// The format file of a log directory holds the version of the format of its
+// segments: [length][CRC32C][batch] frames in the stores. Directories written
+// before it was introduced have no format file, and their stores hold
+// [length][record] frames instead.
+const (
+	formatFile    = "FORMAT"
+	formatVersion = "2"
 )
 
 const (
-	defaultIndexMaxBytes = 1024
-	defaultStoreMaxBytes = 1024
+	defaultIndexMaxBytes          = 1024
+	defaultStoreMaxBytes          = 1024
+	defaultTimeIndexIntervalBytes = 4096
+	defaultSyncRecords            = 1
+	defaultSyncInterval           = time.Second
+
+	defaultRetentionCheckInterval = time.Minute
+	defaultTombstoneRetention     = 24 * time.Hour
 )
 
 type Log struct {
-	mu sync.RWMutex
+	mu        sync.RWMutex
+	compactMu sync.Mutex // held while compacting or removing segments
 
 	Dir    string
 	Config Config
 
 	activeSegment *segment
 	segments      []*segment
+	repairs       []Repair
+
+	unsynced uint64        // number of records appended since the last sync
+	syncErr  error         // error of the last background sync
+	commit   *groupCommit  // batches the syncs of concurrent appends
+	appended chan struct{} // closed and replaced whenever records are appended
+	closed   bool          // set by Close, after which the log can't be used
+
+	done chan struct{}  // closed to stop the background goroutines
+	wg   sync.WaitGroup // background goroutines
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -35,11 +76,27 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = defaultStoreMaxBytes
 	}
+	if c.Segment.TimeIndexIntervalBytes == 0 {
+		c.Segment.TimeIndexIntervalBytes = defaultTimeIndexIntervalBytes
+	}
+	if c.Sync.Records == 0 {
+		c.Sync.Records = defaultSyncRecords
+	}
+	if c.Sync.Interval == 0 {
+		c.Sync.Interval = defaultSyncInterval
+	}
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = defaultRetentionCheckInterval
+	}
+	if c.Compaction.TombstoneRetention == 0 {
+		c.Compaction.TombstoneRetention = defaultTombstoneRetention
+	}
 
 	// Create the log object.
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		commit: newGroupCommit(),
 	}
 	return l, l.setup()
 }
@@ -49,16 +106,25 @@ func NewLog(dir string, c Config) (*Log, error) {
 // - the log directory exists
 // - the log directory contains only valid segment files
 // - the log directory don't necessarily contain any segment files
+// The tail of every existing segment is validated and repaired
+// in case the log was not closed cleanly, and missing or inconsistent
+// indexes are rebuilt from their stores. See Repairs.
 func (l *Log) setup() error {
 	files, err := os.ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
+	l.repairs = nil
 
 	// Build segment list from files.
+	// The store is the source of truth of a segment, so the index file
+	// may be missing. newSegment rebuilds it from the store in that case.
 	var baseOffsets []uint64
 	for _, file := range files {
-		// Get the base offset from the file name. (e.g. 1024.index, 1024.store)
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		// Get the base offset from the file name. (e.g. 1024.store)
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
@@ -66,19 +132,18 @@ func (l *Log) setup() error {
 		off, _ := strconv.ParseUint(offStr, 10, 0)
 		baseOffsets = append(baseOffsets, off)
 	}
+	if err := l.checkFormat(len(baseOffsets) > 0); err != nil {
+		return err
+	}
 	// Sort the base offsets in ascending order.
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
 	// Create a segment for each base offset.
-	for i := 0; i < len(baseOffsets); i++ {
-		if err := l.newSegment(baseOffsets[i]); err != nil {
+	for _, off := range baseOffsets {
+		if err := l.newSegment(off); err != nil {
 			return err
 		}
-		// baseOffsets contains duplicates for index and store
-		// so we skip the next one.
-		// (e.g. 0.index, 0.store, 1.index, 1.store ...)
-		i++
 	}
 
 	// If there are no segments, create a new one.
@@ -89,46 +154,254 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+
+	l.appended = make(chan struct{})
+	l.closed = false
+
+	// Start the background goroutines.
+	l.done = make(chan struct{})
+	if l.Config.Sync.Policy == SyncInterval {
+		l.runEvery(l.Config.Sync.Interval, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if err := l.sync(); err != nil && l.syncErr == nil {
+				l.syncErr = err
+			}
+		})
+	}
+	if l.Config.Retention.MaxAge > 0 || l.Config.Retention.MaxBytes > 0 {
+		// A failed removal is retried at the next check.
+		l.runEvery(l.Config.Retention.CheckInterval, func() {
+			_ = l.enforceRetention(time.Now())
+		})
+	}
+	if l.Config.Compaction.Interval > 0 {
+		// A failed compaction is retried at the next run.
+		l.runEvery(l.Config.Compaction.Interval, func() {
+			_ = l.Compact()
+		})
+	}
+	return nil
+}
+
+// checkFormat returns ErrUnsupportedFormat unless the segments of the log
+// directory, if any, are written in the current format.
+// It marks a directory without segments with the current format.
+func (l *Log) checkFormat(hasSegments bool) error {
+	name := filepath.Join(l.Dir, formatFile)
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		if hasSegments {
+			return fmt.Errorf("%w: %s has segments without a %s file", ErrUnsupportedFormat, l.Dir, formatFile)
+		}
+		return os.WriteFile(name, []byte(formatVersion+"\n"), 0600)
+	}
+	if err != nil {
+		return err
+	}
+	if v := strings.TrimSpace(string(b)); v != formatVersion {
+		return fmt.Errorf("%w: %s has segments of version %q, want %q", ErrUnsupportedFormat, l.Dir, v, formatVersion)
+	}
 	return nil
 }
 
+// runEvery calls fn every interval in the background until the log is closed.
+func (l *Log) runEvery(interval time.Duration, fn func()) {
+	done := l.done
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
 // newSegment creates a new segment and appends it to the log.
 func (l *Log) newSegment(off uint64) error {
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
 	}
+	if !s.repair.empty() {
+		l.repairs = append(l.repairs, s.repair)
+	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 	return nil
 }
 
 // Append appends a record to the log.
+// The record is synced to disk according to Config.Sync.Policy.
+// With SyncEveryRecord, concurrent appends share a single sync
+// and each of them returns once its record is durable.
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.AppendBatch([]*api.Record{record})
+}
+
+// AppendBatch appends the records to the log under one lock acquisition and
+// returns the offset of the first record. The records get consecutive
+// offsets and are stored in one batch of the active segment, so either all
+// of them are appended or none of them.
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	off, err := l.append(records)
+	if err != nil {
+		return 0, err
+	}
+	if l.Config.Sync.Policy == SyncEveryRecord {
+		last := off + uint64(len(records)) - 1
+		if err := l.commit.wait(last, l.syncActive); err != nil {
+			return 0, err
+		}
+	}
+	return off, nil
+}
+
+// append appends a batch of records to the active segment under the lock.
+func (l *Log) append(records []*api.Record) (uint64, error) {
+	if err := l.validateBatch(records); err != nil {
+		return 0, err
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	// If the active segment is full, create a new one.
-	if l.activeSegment.IsMaxed() {
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	// Report the failure of a background sync.
+	if err := l.syncErr; err != nil {
+		l.syncErr = nil
+		return 0, err
+	}
+
+	// If the active segment is full or can't index the whole batch,
+	// create a new one.
+	rolled := l.activeSegment.IsMaxed() || !l.activeSegment.fits(len(records))
+	if rolled {
 		highestOffset, err := l.highestOffset()
 		if err != nil {
 			return 0, err
 		}
 
+		// Persist the records of the full segment before leaving it.
+		if l.Config.Sync.Policy != SyncOS {
+			if err = l.sync(); err != nil {
+				return 0, err
+			}
+		}
+
 		err = l.newSegment(highestOffset + 1)
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	// Append the record to the active segment.
-	off, err := l.activeSegment.Append(record)
+	// Append the records to the active segment.
+	off, err := l.activeSegment.AppendBatch(records)
 	if err != nil {
 		return 0, err
 	}
+	l.unsynced += uint64(len(records))
+
+	// Wake up the consumers waiting for new records.
+	close(l.appended)
+	l.appended = make(chan struct{})
+
+	// Keep the log within its byte budget as it grows.
+	// Segments can't be removed while they are compacted, and a failed
+	// removal is retried at the next retention check.
+	if rolled && l.compactMu.TryLock() {
+		_ = l.removeOversized()
+		l.compactMu.Unlock()
+	}
+
+	if l.Config.Sync.Policy == SyncEveryN && l.unsynced >= l.Config.Sync.Records {
+		if err = l.sync(); err != nil {
+			return 0, err
+		}
+	}
 	return off, nil
 }
 
+// validateBatch checks that the records can be appended to the log
+// as one batch.
+func (l *Log) validateBatch(records []*api.Record) error {
+	if len(records) == 0 {
+		return api.ErrInvalidRecord{Reason: "the batch is empty"}
+	}
+	// A batch must fit in the index of an empty segment.
+	if uint64(len(records))*entWidth > l.Config.Segment.MaxIndexBytes {
+		return api.ErrInvalidRecord{Reason: "the batch has more records than a segment can hold"}
+	}
+	for _, record := range records {
+		if err := validateRecord(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRecord checks that the record can be appended to the log.
+func validateRecord(record *api.Record) error {
+	if record == nil {
+		return api.ErrInvalidRecord{Reason: "the record is missing"}
+	}
+	if record.Tombstone && (len(record.Key) == 0 || len(record.Value) > 0) {
+		return api.ErrInvalidRecord{Reason: "a tombstone needs a key and no value"}
+	}
+	return nil
+}
+
+// Sync commits the records appended to the active segment to stable storage.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	return l.sync()
+}
+
+// syncActive syncs the active segment without holding the lock,
+// so that appends can continue in the meantime.
+// It returns the offset up to which the records are durable.
+func (l *Log) syncActive() (uint64, error) {
+	l.mu.RLock()
+	seg := l.activeSegment
+	next := seg.nextOffset
+	closed := l.closed
+	l.mu.RUnlock()
+	if closed {
+		return 0, ErrClosed
+	}
+
+	// Records of the previous segments were synced when they became full.
+	return next, seg.Sync()
+}
+
+// sync syncs the active segment if it has unsynced records.
+// The caller must hold the lock.
+func (l *Log) sync() error {
+	if l.unsynced == 0 {
+		return nil
+	}
+	if err := l.activeSegment.Sync(); err != nil {
+		return err
+	}
+	l.unsynced = 0
+	return nil
+}
+
 // highestOffset returns the highest offset in the log.
 func (l *Log) highestOffset() (uint64, error) {
 	off := l.segments[len(l.segments)-1].nextOffset
@@ -144,25 +417,163 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	var s *segment
-	for _, seg := range l.segments {
-		if seg.baseOffset <= off && off < seg.nextOffset {
-			s = seg
+	if l.closed {
+		return nil, ErrClosed
+	}
+
+	i := l.findSegment(off)
+	if i < 0 {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return l.segments[i].Read(off)
+}
+
+// ReadRange reads the records from the given offset onwards, walking the
+// segments in order. It stops before exceeding maxRecords records or
+// maxBytes bytes of marshaled records, but always returns at least one
+// record if there is any. A limit of 0 means no limit.
+// The offsets of compacted records are skipped.
+func (l *Log) ReadRange(off uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return nil, ErrClosed
+	}
+
+	i := l.findSegment(off)
+	if i < 0 {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	var records []*api.Record
+	var size uint64
+	for ; i < len(l.segments); i++ {
+		more, err := l.segments[i].readRange(off, func(record *api.Record) bool {
+			if maxRecords > 0 && len(records) >= maxRecords {
+				return false
+			}
+			n := uint64(proto.Size(record))
+			if maxBytes > 0 && size+n > maxBytes && len(records) > 0 {
+				return false
+			}
+			records = append(records, record)
+			size += n
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !more {
 			break
 		}
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	return records, nil
+}
+
+// findSegment returns the index of the segment which holds the given
+// offset, or -1 if the offset is out of the range of the log.
+// The segments are sorted by their base offsets, so it binary searches
+// for the last segment which begins at or before the offset.
+// The caller must hold the lock.
+func (l *Log) findSegment(off uint64) int {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset > off
+	}) - 1
+	if i < 0 {
+		return -1
 	}
-	return s.Read(off)
+	// Compaction may remove the last records of a sealed segment,
+	// so only the active segment ends before the next offset.
+	if i == len(l.segments)-1 && off >= l.segments[i].nextOffset {
+		return -1
+	}
+	return i
 }
 
-// Close closes the all segments in the log.
+// Wait blocks until the log holds a record at or past the given offset,
+// so that consumers at the end of the log don't need to poll.
+// It returns ErrOffsetOutOfRange if the offset was removed from the log,
+// ErrClosed if the log is closed in the meantime, and the error of
+// the context if it is done first.
+func (l *Log) Wait(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		lowest := l.segments[0].baseOffset
+		next := l.activeSegment.nextOffset
+		appended := l.appended
+		closed := l.closed
+		l.mu.RUnlock()
+
+		if closed {
+			return ErrClosed
+		}
+		if off < lowest {
+			return api.ErrOffsetOutOfRange{Offset: off}
+		}
+		if off < next {
+			return nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// OffsetForTime returns the offset of the first record appended at or after
+// the given time. If every record is older, it returns the offset
+// the next record will get.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	for _, seg := range l.segments {
+		if !seg.newest.Before(t) {
+			return seg.OffsetForTime(t)
+		}
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
+// Close syncs and closes all the segments in the log.
+// Afterwards the log fails with ErrClosed; closing it again does nothing.
 func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	// Appends in progress hold the lock, so they finish first,
+	// and the ones after fail with ErrClosed.
+	l.closed = true
+	done := l.done
+	l.done = nil
+	// Wake up the consumers waiting for new records.
+	close(l.appended)
+	l.mu.Unlock()
+
+	// Stop the background goroutines before taking the locks they need.
+	if done != nil {
+		close(done)
+		l.wg.Wait()
+	}
+
+	// Let a compaction in progress finish with the sealed segments.
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	// Persist every segment, whatever the sync policy.
 	for _, seg := range l.segments {
+		if err := seg.Sync(); err != nil {
+			return err
+		}
 		if err := seg.Close(); err != nil {
 			return err
 		}
@@ -186,6 +597,14 @@ func (l *Log) Reset() error {
 	return l.setup()
 }
 
+// Repairs returns what was repaired in each segment when the log was set up.
+// It is empty if the log was closed cleanly.
+func (l *Log) Repairs() []Repair {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.repairs
+}
+
 // LowestOffset returns the lowest base offset of the log.
 // Conditions:
 // - the log contains at least one segment
@@ -202,21 +621,56 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return l.highestOffset()
 }
 
+// Size returns the number of bytes the log occupies on disk,
+// counting the records in the stores and the entries in the offset and
+// time indexes.
+func (l *Log) Size() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.size()
+}
+
+// size returns the size of the log. The caller must hold the lock.
+func (l *Log) size() uint64 {
+	var size uint64
+	for _, seg := range l.segments {
+		size += seg.size()
+	}
+	return size
+}
+
 // Truncate removes the segments which have a next offset less than the given offset.
 // This method is used to remove old segments in order to free up disk space.
+// If the active segment is removed, a new one takes its place, so that
+// the log goes on from the offset after its highest one.
 func (l *Log) Truncate(lowest uint64) error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if l.closed {
+		return ErrClosed
+	}
+	active := l.activeSegment
 	var segments []*segment
 	for _, seg := range l.segments {
-		if seg.nextOffset <= lowest+1 {
-			if err := seg.Remove(); err != nil {
+		if seg.nextOffset > lowest+1 || (seg == active && seg.nextOffset == seg.baseOffset) {
+			// Keep the segment, or the active one if it holds nothing to remove.
+			segments = append(segments, seg)
+			continue
+		}
+		if seg == active {
+			// Roll before removing it, so that the log is never
+			// left without an active segment.
+			if err := l.newSegment(seg.nextOffset); err != nil {
 				return err
 			}
-			continue
+			segments = append(segments, l.activeSegment)
+		}
+		if err := seg.Remove(); err != nil {
+			return err
 		}
-		segments = append(segments, seg)
 	}
 	l.segments = segments // update segments
 	return nil
@@ -1,9 +1,13 @@
 package log
 
 import (
+	"context"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/sota0121/proglog/api/v1"
 	"github.com/stretchr/testify/require"
@@ -12,11 +16,17 @@ import (
 
 func TestLog(t *testing.T) {
 	testMap := map[string]func(t *testing.T, log *Log){
-		"append and read a record succeeds": testAppendRead,
-		"offset out of range error":         testOutOfRangeErr,
-		"init with existing segments":       testInitExisting,
-		"reader":                            testReader,
-		"truncate":                          testTruncate,
+		"append and read a record succeeds":  testAppendRead,
+		"offset out of range error":          testOutOfRangeErr,
+		"init with existing segments":        testInitExisting,
+		"reader":                             testReader,
+		"truncate":                           testTruncate,
+		"append after truncating everything": testTruncateAll,
+		"offset for time":                    testOffsetForTime,
+		"append a batch of records":          testAppendBatch,
+		"read a range of records":            testReadRange,
+		"wait for an append":                 testWait,
+		"closed log fails":                   testClosed,
 	}
 
 	for scenario, fn := range testMap {
@@ -105,10 +115,10 @@ func testReader(t *testing.T, log *Log) {
 	b, err := io.ReadAll(reader) // read all the records from the log
 	require.NoError(t, err)
 
-	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read) // unmarshal the record
+	read, err := decodeBatch(b[headerWidth:]) // decode the batch of the record
 	require.NoError(t, err)
-	require.Equal(t, append.Value, read.Value)
+	require.Len(t, read, 1)
+	require.Equal(t, append.Value, read[0].Value)
 	require.NoError(t, log.Close())
 }
 
@@ -131,3 +141,408 @@ func testTruncate(t *testing.T, log *Log) {
 	require.Error(t, err)
 	require.NoError(t, log.Close())
 }
+
+// testTruncateAll tests that the log goes on after its highest offset
+// once every record is truncated.
+func testTruncateAll(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(highest))
+
+	_, err = log.Read(highest)
+	require.Error(t, err)
+	low, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, highest+1, low)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, highest+1, off)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+
+	// Truncating the new, empty active segment keeps it.
+	require.NoError(t, log.Truncate(off))
+	require.NoError(t, log.Truncate(off+10))
+	off, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, highest+2, off)
+	require.NoError(t, log.Close())
+}
+
+// testAppendBatch tests that a batch gets consecutive offsets and is
+// appended all together or not at all.
+func testAppendBatch(t *testing.T, log *Log) {
+	batch := []*api.Record{
+		{Value: []byte("first")},
+		{Key: []byte("key"), Value: []byte("second")},
+		{Key: []byte("key"), Tombstone: true},
+	}
+	off, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	for i, want := range batch {
+		got, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), got.Offset)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// An invalid record fails the whole batch.
+	_, err = log.AppendBatch([]*api.Record{
+		{Value: []byte("hello world")},
+		{Tombstone: true},
+	})
+	require.Equal(t, api.ErrInvalidRecord{Reason: "a tombstone needs a key and no value"}, err)
+	_, err = log.AppendBatch(nil)
+	require.Equal(t, api.ErrInvalidRecord{Reason: "the batch is empty"}, err)
+	_, err = log.AppendBatch([]*api.Record{{Value: []byte("hello world")}, nil})
+	require.Equal(t, api.ErrInvalidRecord{Reason: "the record is missing"}, err)
+	_, err = log.AppendBatch(make([]*api.Record, log.Config.Segment.MaxIndexBytes/entWidth+1))
+	require.Equal(t, api.ErrInvalidRecord{
+		Reason: "the batch has more records than a segment can hold",
+	}, err)
+	off, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, log.Close())
+}
+
+// testReadRange tests that a range of records is read across segments
+// within the limits.
+func testReadRange(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	requireOffsets := func(want []uint64, maxRecords int, maxBytes uint64) {
+		t.Helper()
+		records, err := log.ReadRange(1, maxRecords, maxBytes)
+		require.NoError(t, err)
+		got := make([]uint64, len(records))
+		for i, record := range records {
+			got[i] = record.Offset
+		}
+		require.Equal(t, want, got)
+	}
+	requireOffsets([]uint64{1, 2, 3, 4}, 0, 0)
+	requireOffsets([]uint64{1, 2}, 2, 0)
+	// At least one record is returned even if it exceeds maxBytes.
+	requireOffsets([]uint64{1}, 0, 1)
+
+	_, err := log.ReadRange(5, 0, 0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+	require.NoError(t, log.Close())
+}
+
+// testWait tests that waiting consumers wake up on appends.
+func testWait(t *testing.T, log *Log) {
+	waited := make(chan error)
+	go func() {
+		waited <- log.Wait(context.Background(), 1)
+	}()
+
+	// The first record doesn't reach the awaited offset.
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	select {
+	case err := <-waited:
+		t.Fatalf("wait returned early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, <-waited)
+
+	// Records which are already in the log need no waiting.
+	require.NoError(t, log.Wait(context.Background(), 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, log.Wait(ctx, 2))
+
+	// Removed records can't be waited for.
+	require.NoError(t, log.Truncate(0))
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, log.Wait(context.Background(), 0))
+	require.NoError(t, log.Close())
+}
+
+// testClosed tests that the log can't be used once it is closed.
+func testClosed(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	waited := make(chan error)
+	go func() {
+		waited <- log.Wait(context.Background(), 1)
+	}()
+
+	require.NoError(t, log.Close())
+	require.Equal(t, ErrClosed, <-waited)
+	require.True(t, storeSynced(t, log))
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrClosed, err)
+	_, err = log.Read(0)
+	require.Equal(t, ErrClosed, err)
+	require.NoError(t, log.Close())
+}
+
+// testOffsetForTime tests it can find records by their append time.
+func testOffsetForTime(t *testing.T, log *Log) {
+	before := time.Now()
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond)
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		times = append(times, read.Timestamp.AsTime())
+	}
+
+	tests := []struct {
+		at   time.Time
+		want uint64
+	}{
+		{at: before, want: 0},
+		{at: time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC), want: 0},
+		{at: time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC), want: 0},
+		{at: time.Time{}, want: 0},
+		{at: times[0], want: 0},
+		{at: times[1], want: 1},
+		{at: times[1].Add(time.Nanosecond), want: 2},
+		{at: times[2].Add(time.Nanosecond), want: 3}, // the next offset
+	}
+	for _, tc := range tests {
+		off, err := log.OffsetForTime(tc.at)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, off, "offset for %v", tc.at)
+	}
+	require.NoError(t, log.Close())
+}
+
+// TestLogSync tests when each sync policy persists the appended records.
+func TestLogSync(t *testing.T) {
+	testMap := map[string]struct {
+		policy SyncPolicy
+		// synced tells whether the records must be on disk after the n-th append.
+		synced func(n int) bool
+	}{
+		"os":           {SyncOS, func(n int) bool { return false }},
+		"every record": {SyncEveryRecord, func(n int) bool { return true }},
+		"every n":      {SyncEveryN, func(n int) bool { return n%2 == 0 }},
+	}
+
+	for scenario, tc := range testMap {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "log-sync-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Sync.Policy = tc.policy
+			c.Sync.Records = 2
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			for n := 1; n <= 4; n++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+				require.Equal(t, tc.synced(n), storeSynced(t, log), "append %d", n)
+			}
+		})
+	}
+
+	t.Run("interval", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "log-sync-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		c := Config{}
+		c.Sync.Policy = SyncInterval
+		c.Sync.Interval = 10 * time.Millisecond
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer log.Close()
+
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return storeSynced(t, log)
+		}, time.Second, c.Sync.Interval)
+	})
+}
+
+// storeSynced returns true if the store file of the active segment
+// contains every appended record.
+func storeSynced(t *testing.T, log *Log) bool {
+	t.Helper()
+
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+	fi, err := os.Stat(log.activeSegment.store.Name())
+	require.NoError(t, err)
+	return uint64(fi.Size()) == log.activeSegment.store.size
+}
+
+// TestLogGroupCommit tests that concurrent appends are durable when they return.
+func TestLogGroupCommit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-group-commit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.MaxIndexBytes = 4096
+	c.Sync.Policy = SyncEveryRecord
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Hold the syncs back until every producer has appended its first
+	// record, so that one sync has to commit the records of all of them.
+	log.commit.mu.Lock()
+	log.commit.syncing = true
+	log.commit.mu.Unlock()
+
+	const producers, records = 8, 50
+	offsets := make(chan uint64, producers*records)
+	errc := make(chan error, producers)
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				off, err := log.Append(&api.Record{Value: []byte("hello world")})
+				if err != nil {
+					errc <- err
+					return
+				}
+				offsets <- off
+			}
+		}()
+	}
+	require.Eventually(t, func() bool {
+		off, err := log.HighestOffset()
+		return err == nil && off == producers-1
+	}, 5*time.Second, time.Millisecond)
+	log.commit.mu.Lock()
+	log.commit.syncing = false
+	log.commit.cond.Broadcast()
+	log.commit.mu.Unlock()
+	wg.Wait()
+	close(offsets)
+	close(errc)
+	for err := range errc {
+		require.NoError(t, err)
+	}
+
+	// Every record got its own offset and is on disk.
+	seen := make(map[uint64]bool)
+	for off := range offsets {
+		require.False(t, seen[off])
+		seen[off] = true
+	}
+	require.Len(t, seen, producers*records)
+	require.True(t, storeSynced(t, log))
+	require.Less(t, log.commit.syncs, uint64(producers*records))
+}
+
+// TestLogUnsupportedFormat tests that segments written before the format
+// file are refused instead of being repaired away.
+func TestLogUnsupportedFormat(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-format-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Write a store of [length][record] frames, as the log did before
+	// records were checksummed, and its index.
+	var store, index []byte
+	for off := uint64(0); off < 3; off++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: off})
+		require.NoError(t, err)
+		entry := make([]byte, entWidth)
+		enc.PutUint32(entry, uint32(off))
+		enc.PutUint64(entry[offWidth:], uint64(len(store)))
+		index = append(index, entry...)
+		frame := make([]byte, lenWidth)
+		enc.PutUint64(frame, uint64(len(p)))
+		store = append(append(store, frame...), p...)
+	}
+	storeFile := filepath.Join(dir, "0.store")
+	require.NoError(t, os.WriteFile(storeFile, store, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.index"), index, 0600))
+
+	_, err = NewLog(dir, Config{})
+	require.ErrorIs(t, err, ErrUnsupportedFormat)
+	b, err := os.ReadFile(storeFile)
+	require.NoError(t, err)
+	require.Equal(t, store, b)
+
+	// Nor are the segments of another version read.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, formatFile), []byte("3\n"), 0600))
+	_, err = NewLog(dir, Config{})
+	require.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+// TestFindSegment tests the lookup of the segment which holds an offset.
+func TestFindSegment(t *testing.T) {
+	// The second segment lost its last records to compaction.
+	log := &Log{segments: []*segment{
+		{baseOffset: 10, nextOffset: 20},
+		{baseOffset: 20, nextOffset: 25},
+		{baseOffset: 30, nextOffset: 35},
+	}}
+	for off, want := range map[uint64]int{
+		0: -1, 9: -1, 10: 0, 19: 0, 20: 1, 27: 1, 30: 2, 34: 2, 35: -1,
+	} {
+		require.Equal(t, want, log.findSegment(off), "offset %d", off)
+	}
+}
+
+// BenchmarkFindSegment compares the binary search for the segment of
+// an offset with a linear scan over 10k segments.
+func BenchmarkFindSegment(b *testing.B) {
+	const numOfSegments = 10000
+	const recordsPerSegment = 100
+	log := &Log{}
+	for i := uint64(0); i < numOfSegments; i++ {
+		log.segments = append(log.segments, &segment{
+			baseOffset: i * recordsPerSegment,
+			nextOffset: (i + 1) * recordsPerSegment,
+		})
+	}
+	end := uint64(numOfSegments * recordsPerSegment)
+
+	// The linear scan Log.Read used to do.
+	b.Run("linear", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			off := uint64(n*7919) % end
+			found := false
+			for _, seg := range log.segments {
+				if seg.baseOffset <= off && off < seg.nextOffset {
+					found = true
+					break
+				}
+			}
+			if !found {
+				b.Fatal("segment not found")
+			}
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if log.findSegment(uint64(n*7919)%end) < 0 {
+				b.Fatal("segment not found")
+			}
+		}
+	})
+}
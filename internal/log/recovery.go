@@ -0,0 +1,206 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrIndexTooSmall is returned when opening a segment whose records don't fit
+// in Config.Segment.MaxIndexBytes. Nothing is truncated: the log opens again
+// with the Segment.MaxIndexBytes the segment was written with.
+var ErrIndexTooSmall = errors.New("log: Segment.MaxIndexBytes too small for the existing segments")
+
+// Repair describes what was fixed in a segment while opening the log
+// after an unclean shutdown.
+type Repair struct {
+	BaseOffset     uint64 // base offset of the repaired segment
+	TruncatedBytes uint64 // bytes of partial or damaged frames cut from the store
+	DroppedEntries uint64 // index entries which pointed at missing or damaged frames
+	RebuiltEntries uint64 // index entries regenerated from the store
+	IndexRebuilt   bool   // the index was missing or inconsistent and was regenerated as a whole
+}
+
+// empty returns true if nothing was repaired.
+func (r Repair) empty() bool {
+	return r.TruncatedBytes == 0 && r.DroppedEntries == 0 && r.RebuiltEntries == 0 &&
+		!r.IndexRebuilt
+}
+
+// recover validates the tail of the segment and repairs it in place.
+// The process may have died in the middle of store.Append or before
+// index.Close shrank the memory-mapped file, so:
+//   - trailing index entries which are zero-filled or point past the store are dropped
+//   - the batch of the last index entry and every batch after it are verified
+//   - missing index entries are written for the valid frames found in the store
+//   - the first partial or damaged frame and everything after it are truncated;
+//     a frame is damaged if it fails its checksum or its offsets go backwards
+//
+// If the index is missing or inconsistent, it is rebuilt from the store,
+// which is the single source of truth.
+func (s *segment) recover() (Repair, error) {
+	r := Repair{BaseOffset: s.baseOffset}
+
+	// Walk the index backwards until we find an entry which may be valid.
+	size := s.index.size
+	if size > uint64(len(s.index.mmap)) {
+		size = uint64(len(s.index.mmap))
+	}
+	n := size / entWidth
+	for ; n > 0; n-- {
+		off, pos := s.index.entry(n - 1)
+		// Zero-filled entries are preallocated space of the memory-mapped
+		// file which was never written, so they are not counted as dropped.
+		if n > 1 && off == 0 && pos == 0 {
+			continue
+		}
+		if pos+headerWidth <= s.store.size {
+			break
+		}
+		r.DroppedEntries++
+	}
+	valid := n
+
+	// Rebuild the whole index if it is missing or the remaining entries
+	// don't describe the store.
+	if (n == 0 && s.store.size > 0) || !s.indexConsistent(n) {
+		r.IndexRebuilt = true
+		r.DroppedEntries = 0
+		n, valid = 0, 0
+	}
+
+	// Verify the batches from the one of the last index entry onwards.
+	var pos uint64
+	if n > 0 {
+		n--
+		_, pos = s.index.entry(n)
+		// Reindex the whole batch, whose records share its position.
+		for ; n > 0; n-- {
+			if _, prev := s.index.entry(n - 1); prev != pos {
+				break
+			}
+		}
+	}
+	s.index.size = n * entWidth
+	// Offsets increase through the segment, so a frame whose records don't
+	// follow the last indexed one, such as zero-filled space, is damaged.
+	last, indexed := uint64(0), n > 0
+	if indexed {
+		off, _ := s.index.entry(n - 1)
+		last = s.baseOffset + uint64(off)
+	}
+frames:
+	for {
+		records, next, err := s.readFrame(pos)
+		if err == io.EOF || err == errCorruptFrame {
+			break
+		}
+		if err != nil {
+			return r, err
+		}
+		for _, record := range records {
+			if record.Offset < s.baseOffset || (indexed && record.Offset <= last) {
+				break frames
+			}
+			last, indexed = record.Offset, true
+		}
+		// The frame is valid, so the index must have room for it. It hasn't
+		// if the segment was written with a larger Segment.MaxIndexBytes.
+		if !s.fits(len(records)) {
+			return r, fmt.Errorf("%w: segment %d holds more than %d bytes of entries",
+				ErrIndexTooSmall, s.baseOffset, s.config.Segment.MaxIndexBytes)
+		}
+		// Offsets may have gaps after compaction, so take them from the records.
+		for _, record := range records {
+			if err = s.index.Write(uint32(record.Offset-s.baseOffset), pos); err != nil {
+				return r, err
+			}
+		}
+		n += uint64(len(records))
+		pos = next
+	}
+	if n < valid {
+		r.DroppedEntries += valid - n
+	} else {
+		r.RebuiltEntries = n - valid
+	}
+
+	// Cut off whatever follows the last valid frame.
+	if pos < s.store.size {
+		r.TruncatedBytes = s.store.size - pos
+		if err := s.store.Truncate(pos); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// indexConsistent returns true if the first n index entries have increasing
+// offsets and non-decreasing positions which lie within the store.
+func (s *segment) indexConsistent(n uint64) bool {
+	var prevOff uint32
+	var prevPos uint64
+	for i := uint64(0); i < n; i++ {
+		off, pos := s.index.entry(i)
+		if pos+headerWidth > s.store.size || (i > 0 && (off <= prevOff || pos < prevPos)) {
+			return false
+		}
+		prevOff, prevPos = off, pos
+	}
+	return true
+}
+
+// recoverTimeIndex drops the time index entries which don't describe the
+// segment, and rebuilds the time index from the store if it is empty.
+// Missing entries only make time lookups scan further, so the time index
+// is not reported as a repair.
+func (s *segment) recoverTimeIndex() error {
+	t := s.timeIndex
+	size := t.size
+	if size > uint64(len(t.mmap)) {
+		size = uint64(len(t.mmap))
+	}
+
+	// Keep the entries with increasing offsets and times within the segment.
+	var n, prevAt uint64
+	var prevOff uint32
+	for ; n < size/entWidth; n++ {
+		off, at := t.entry(n)
+		if at == 0 || uint64(off) >= s.nextOffset-s.baseOffset ||
+			(n > 0 && (off <= prevOff || at < prevAt)) {
+			break
+		}
+		prevOff, prevAt = off, at
+	}
+	t.size = n * entWidth
+	if n > 0 {
+		_, pos, err := s.index.Read(int64(s.index.Find(prevOff)))
+		if err != nil {
+			return err
+		}
+		t.lastPos = pos
+		return nil
+	}
+
+	// Rebuild the time index from the records in the store.
+	return s.frames(func(_ uint32, pos uint64) error {
+		records, _, err := s.readFrame(pos)
+		if err == errCorruptFrame {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			// Records written before timestamps were introduced can't be indexed.
+			if record.Timestamp == nil {
+				continue
+			}
+			rel := uint32(record.Offset - s.baseOffset)
+			if err := t.Write(rel, pos, record.Timestamp.AsTime()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
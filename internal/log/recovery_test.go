@@ -0,0 +1,344 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "github.com/sota0121/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecover(t *testing.T) {
+	testMap := map[string]func(t *testing.T, dir string, c Config){
+		"clean shutdown needs no repair":     testRecoverClean,
+		"partial frame is truncated":         testRecoverPartialFrame,
+		"missing index entries are rebuilt":  testRecoverMissingEntries,
+		"entries past the store are dropped": testRecoverDanglingEntries,
+		"log reports repaired segments":      testRecoverLog,
+		"missing index is rebuilt":           testRebuildMissingIndex,
+		"inconsistent index is rebuilt":      testRebuildInconsistentIndex,
+		"log rebuilds a deleted index":       testRebuildLogIndex,
+		"missing time index is rebuilt":      testRebuildTimeIndex,
+		"batches are reindexed as a whole":   testRecoverBatch,
+		"zero-filled tail is truncated":      testRecoverZeroTail,
+		"smaller index refuses to open":      testRecoverSmallerIndex,
+	}
+
+	for scenario, fn := range testMap {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "recovery-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			fn(t, dir, c)
+		})
+	}
+}
+
+// crash leaves the segment files as they would be if the process died:
+// buffered writes reach the store, but the indexes are never shrunk.
+func crash(t *testing.T, s *segment) {
+	t.Helper()
+
+	require.NoError(t, s.store.buf.Flush())
+	require.NoError(t, s.store.File.Close())
+	require.NoError(t, s.index.mmap.UnsafeUnmap())
+	require.NoError(t, s.index.file.Close())
+	require.NoError(t, s.timeIndex.mmap.UnsafeUnmap())
+	require.NoError(t, s.timeIndex.file.Close())
+}
+
+// appendRecords appends n records to the segment.
+func appendRecords(t *testing.T, s *segment, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		_, err := s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+}
+
+// position returns the store position of the record with the given offset.
+func position(t *testing.T, s *segment, off uint64) uint64 {
+	t.Helper()
+
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	require.NoError(t, err)
+	return pos
+}
+
+func testRecoverClean(t *testing.T, dir string, c Config) {
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 3)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.True(t, s.repair.empty())
+	require.Equal(t, uint64(3), s.nextOffset)
+	require.NoError(t, s.Close())
+}
+
+func testRecoverPartialFrame(t *testing.T, dir string, c Config) {
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 3)
+	size := s.store.size
+	crash(t, s)
+
+	// Write the first half of a frame to the store.
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, headerWidth/2))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, Repair{TruncatedBytes: headerWidth / 2}, s.repair)
+	require.Equal(t, uint64(3), s.nextOffset)
+	require.Equal(t, size, s.store.size)
+
+	// The segment keeps working after the repair.
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	for i := uint64(0); i < 4; i++ {
+		_, err := s.Read(i)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+}
+
+func testRecoverZeroTail(t *testing.T, dir string, c Config) {
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 3)
+	size := s.store.size
+	require.NoError(t, s.Close())
+
+	// Zero-fill the space of two empty frames, whose checksums match.
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 2*headerWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, Repair{TruncatedBytes: 2 * headerWidth}, s.repair)
+	require.Equal(t, uint64(3), s.nextOffset)
+	require.Equal(t, size, s.store.size)
+	for i := uint64(0); i < 3; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, got.Offset)
+	}
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, s.Close())
+}
+
+func testRecoverSmallerIndex(t *testing.T, dir string, c Config) {
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 10)
+	size := s.store.size
+	require.NoError(t, s.Close())
+
+	small := c
+	small.Segment.MaxIndexBytes = 5 * entWidth
+	_, err = newSegment(dir, 0, small)
+	require.ErrorIs(t, err, ErrIndexTooSmall)
+	fi, err := os.Stat(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, size, uint64(fi.Size()))
+
+	// Every record is back with the index size it was written with.
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), s.nextOffset)
+	for i := uint64(0); i < 10; i++ {
+		_, err := s.Read(i)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+}
+
+func testRecoverMissingEntries(t *testing.T, dir string, c Config) {
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 3)
+
+	// Lose the last two index entries.
+	copy(s.index.mmap[entWidth:], make([]byte, 2*entWidth))
+	crash(t, s)
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, Repair{RebuiltEntries: 2}, s.repair)
+	require.Equal(t, uint64(3), s.nextOffset)
+	for i := uint64(0); i < 3; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, got.Offset)
+	}
+	require.NoError(t, s.Close())
+}
+
+func testRecoverDanglingEntries(t *testing.T, dir string, c Config) {
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 3)
+	pos1, pos2 := position(t, s, 1), position(t, s, 2)
+	crash(t, s)
+
+	// Lose the last record and half of the one before it.
+	require.NoError(t, os.Truncate(s.store.Name(), int64(pos1+(pos2-pos1)/2)))
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, Repair{
+		TruncatedBytes: (pos2 - pos1) / 2,
+		DroppedEntries: 2,
+	}, s.repair)
+	require.Equal(t, uint64(1), s.nextOffset)
+	require.Equal(t, pos1, s.store.size)
+	require.NoError(t, s.Close())
+}
+
+func testRecoverLog(t *testing.T, dir string, c Config) {
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, l.segments, 2)
+	for _, s := range l.segments {
+		crash(t, s)
+	}
+
+	// Tear the record of the active segment.
+	active := l.segments[1]
+	require.NoError(t, os.Truncate(active.store.Name(), int64(headerWidth+1)))
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []Repair{{
+		BaseOffset:     3,
+		TruncatedBytes: headerWidth + 1,
+		DroppedEntries: 1,
+	}}, l.Repairs())
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, l.Close())
+}
+
+func testRebuildMissingIndex(t *testing.T, dir string, c Config) {
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 3)
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Remove(s.index.Name()))
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, Repair{RebuiltEntries: 3, IndexRebuilt: true}, s.repair)
+	require.Equal(t, uint64(3), s.nextOffset)
+	for i := uint64(0); i < 3; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, got.Offset)
+	}
+	require.NoError(t, s.Close())
+}
+
+func testRebuildInconsistentIndex(t *testing.T, dir string, c Config) {
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 3)
+
+	// Damage an entry in the middle of the index.
+	enc.PutUint64(s.index.mmap[entWidth+offWidth:], 1<<40)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, Repair{RebuiltEntries: 3, IndexRebuilt: true}, s.repair)
+	got, err := s.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), got.Offset)
+	require.NoError(t, s.Close())
+}
+
+func testRebuildLogIndex(t *testing.T, dir string, c Config) {
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+	require.NoError(t, os.Remove(l.segments[0].index.Name()))
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []Repair{{RebuiltEntries: 3, IndexRebuilt: true}}, l.Repairs())
+	for i := uint64(0); i < 4; i++ {
+		got, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, got.Offset)
+	}
+	require.NoError(t, l.Close())
+}
+
+func testRebuildTimeIndex(t *testing.T, dir string, c Config) {
+	c.Segment.TimeIndexIntervalBytes = 1
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 3)
+	want := s.timeIndex.size
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Remove(s.timeIndex.Name()))
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, want, s.timeIndex.size)
+	require.Equal(t, 3*entWidth, s.timeIndex.size)
+	rec, err := s.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, rec.Timestamp.AsTime(), s.newest)
+	require.NoError(t, s.Close())
+}
+
+func testRecoverBatch(t *testing.T, dir string, c Config) {
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	appendRecords(t, s, 1)
+	require.NoError(t, s.write(stampedRecords(1, 3)))
+
+	// Lose the index entries of the last two records of the batch.
+	copy(s.index.mmap[2*entWidth:], make([]byte, 2*entWidth))
+	crash(t, s)
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, Repair{RebuiltEntries: 2}, s.repair)
+	require.Equal(t, uint64(4), s.nextOffset)
+	for i := uint64(1); i < 4; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, got.Offset)
+		require.Equal(t, position(t, s, 1), position(t, s, i))
+	}
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,69 @@
+package log
+
+import "time"
+
+// enforceRetention removes the oldest segments which exceed the limits of
+// Config.Retention at the given time. The active segment is never removed.
+func (l *Log) enforceRetention(now time.Time) error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.removeExpired(now); err != nil {
+		return err
+	}
+	return l.removeOversized()
+}
+
+// removeExpired removes the oldest segments whose newest record is older than
+// Config.Retention.MaxAge at the given time.
+// The caller must hold the lock.
+func (l *Log) removeExpired(now time.Time) error {
+	if l.Config.Retention.MaxAge == 0 {
+		return nil
+	}
+
+	// Segments are ordered by age, so stop at the first one to keep.
+	var n int
+	for _, seg := range l.segments[:len(l.segments)-1] {
+		if now.Sub(seg.newest) <= l.Config.Retention.MaxAge {
+			break
+		}
+		n++
+	}
+	return l.removeOldest(n)
+}
+
+// removeOversized removes the oldest segments while the log is larger than
+// Config.Retention.MaxBytes.
+// The caller must hold the lock.
+func (l *Log) removeOversized() error {
+	if l.Config.Retention.MaxBytes == 0 {
+		return nil
+	}
+
+	size := l.size()
+	var n int
+	for _, seg := range l.segments[:len(l.segments)-1] {
+		if size <= l.Config.Retention.MaxBytes {
+			break
+		}
+		size -= seg.size()
+		n++
+	}
+	return l.removeOldest(n)
+}
+
+// removeOldest removes the n oldest segments.
+// The caller must hold the lock.
+func (l *Log) removeOldest(n int) error {
+	for i, seg := range l.segments[:n] {
+		if err := seg.Remove(); err != nil {
+			l.segments = l.segments[i:]
+			return err
+		}
+	}
+	l.segments = l.segments[n:]
+	return nil
+}
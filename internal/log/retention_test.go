@@ -0,0 +1,144 @@
+package log
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/sota0121/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	testMap := map[string]func(t *testing.T, log *Log){
+		"expired segments are removed":                     testRemoveExpired,
+		"active segment is never removed":                  testRemoveExpiredActive,
+		"expired segments are removed in the background":   testRemoveExpiredBackground,
+		"oldest segments are removed over the byte budget": testRemoveOversized,
+		"removed segments are unmapped":                    testRemoveUnmapped,
+	}
+
+	for scenario, fn := range testMap {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 2
+			c.Retention.MaxAge = time.Hour
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			// Fill three segments.
+			for i := 0; i < 5; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.Len(t, log.segments, 3)
+
+			fn(t, log)
+		})
+	}
+}
+
+func testRemoveExpired(t *testing.T, log *Log) {
+	now := time.Now()
+	log.segments[0].newest = now.Add(-3 * time.Hour)
+	log.segments[1].newest = now.Add(-30 * time.Minute)
+
+	require.NoError(t, log.enforceRetention(now))
+	require.Len(t, log.segments, 2)
+	_, err := log.Read(1)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+	_, err = log.Read(2)
+	require.NoError(t, err)
+
+	// The second segment expires later.
+	require.NoError(t, log.enforceRetention(now.Add(time.Hour)))
+	require.Len(t, log.segments, 1)
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
+
+func testRemoveExpiredActive(t *testing.T, log *Log) {
+	require.NoError(t, log.enforceRetention(time.Now().Add(24*time.Hour)))
+	require.Len(t, log.segments, 1)
+	_, err := log.Read(4)
+	require.NoError(t, err)
+
+	// The log keeps appending to the active segment.
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func testRemoveExpiredBackground(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+
+	c := log.Config
+	c.Retention.MaxAge = time.Millisecond
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return len(log.segments) == 1
+	}, time.Second, c.Retention.CheckInterval)
+}
+
+func testRemoveOversized(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+
+	// Allow the log to keep what it holds now.
+	c := log.Config
+	c.Retention.MaxAge = 0
+	c.Retention.MaxBytes = log.Size()
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Fill the active segment and open a new one.
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.LessOrEqual(t, log.Size(), c.Retention.MaxBytes)
+	low, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, low, uint64(0))
+	high, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), high)
+	for off := low; off <= high; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+}
+
+func testRemoveUnmapped(t *testing.T, log *Log) {
+	require.NoError(t, log.enforceRetention(time.Now().Add(24*time.Hour)))
+	require.Len(t, log.segments, 1)
+
+	// Only the indexes of the active segment remain mapped.
+	maps, err := os.ReadFile("/proc/self/maps")
+	if err != nil {
+		t.Skip("no /proc/self/maps:", err)
+	}
+	var mapped []string
+	for _, line := range strings.Split(string(maps), "\n") {
+		if strings.Contains(line, log.Dir) {
+			mapped = append(mapped, line)
+		}
+	}
+	require.Len(t, mapped, 2, strings.Join(mapped, "\n"))
+	for _, line := range mapped {
+		require.NotContains(t, line, "(deleted)")
+	}
+}
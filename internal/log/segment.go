@@ -2,18 +2,23 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	api "github.com/sota0121/proglog/api/v1"
-	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
 	config                 Config
+	repair                 Repair    // what was repaired while opening the segment
+	newest                 time.Time // when the newest record was appended
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -35,50 +40,248 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
+	if s.repair, err = s.recover(); err != nil {
+		return nil, err
+	}
 	if off, _, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+	timeIndexFile, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, c); err != nil {
+		return nil, err
+	}
+	if err = s.recoverTimeIndex(); err != nil {
+		return nil, err
+	}
+	if s.newest, err = s.newestTime(); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
+// newestTime returns the append time of the newest record in the segment.
+// Records written before timestamps were introduced fall back to
+// the modification time of the store.
+func (s *segment) newestTime() (time.Time, error) {
+	if off, pos, err := s.index.Read(-1); err == nil {
+		record, err := s.readAt(pos, s.baseOffset+uint64(off))
+		if err == nil && record.Timestamp != nil {
+			return record.Timestamp.AsTime(), nil
+		}
+	}
+	fi, err := s.store.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
 // Append appends a record from gRPC request to the segment.
+// The record is stamped with its offset and append time.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	return s.AppendBatch([]*api.Record{record})
+}
+
+// AppendBatch appends the records to the segment as one batch and returns
+// the offset of the first record. The records are stamped with consecutive
+// offsets and the same append time.
+// Either all the records are appended or none of them.
+func (s *segment) AppendBatch(records []*api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
-	record.Offset = cur
-	p, err := proto.Marshal(record)
-	if err != nil {
+	// Keep the append times of the segment in order
+	// even if the wall clock goes backwards.
+	now := time.Now()
+	if now.Before(s.newest) {
+		now = s.newest
+	}
+	for i, record := range records {
+		record.Offset = cur + uint64(i)
+		record.Timestamp = timestamppb.New(now)
+	}
+	if err = s.write(records); err != nil {
 		return 0, err
 	}
+	return cur, nil
+}
+
+// write stores the stamped records as one batch and indexes each of them
+// at the position of the batch. Offsets must increase but may have gaps.
+func (s *segment) write(records []*api.Record) error {
+	// Check the room in the index first so that a batch is never
+	// indexed partially.
+	if !s.fits(len(records)) {
+		return io.EOF
+	}
+	p, err := encodeBatch(records, s.config.Segment.Codec)
+	if err != nil {
+		return err
+	}
 	_, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	if err = s.index.Write(
+	for _, record := range records {
 		// index offsets are relative to the base offset
-		uint32(cur-s.baseOffset),
-		pos,
-	); err != nil {
+		rel := uint32(record.Offset - s.baseOffset)
+		if err = s.index.Write(rel, pos); err != nil {
+			return err
+		}
+		if err = s.timeIndex.Write(rel, pos, record.Timestamp.AsTime()); err != nil {
+			return err
+		}
+	}
+	last := records[len(records)-1]
+	s.nextOffset = last.Offset + 1
+	s.newest = last.Timestamp.AsTime()
+	return nil
+}
+
+// OffsetForTime returns the offset of the first record in the segment
+// appended at or after the given time, or nextOffset if there is none.
+func (s *segment) OffsetForTime(t time.Time) (uint64, error) {
+	// Start from the last indexed record appended before t.
+	var rel uint32
+	if off, ok := s.timeIndex.Lookup(t); ok {
+		rel = off
+	}
+	off := s.nextOffset
+	_, err := s.readRange(s.baseOffset+uint64(rel), func(record *api.Record) bool {
+		if !record.Timestamp.AsTime().Before(t) {
+			off = record.Offset
+			return false
+		}
+		return true
+	})
+	if err != nil {
 		return 0, err
 	}
-	s.nextOffset++
-	return cur, nil
+	return off, nil
 }
 
 // Read reads a record from the segment with the given offset.
+// It returns ErrOffsetCompacted if the record was removed by compaction.
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	rel := uint32(off - s.baseOffset)
+	out, pos, err := s.index.Read(int64(s.index.Find(rel)))
+	if err == io.EOF || (err == nil && out != rel) {
+		return nil, api.ErrOffsetCompacted{Offset: off}
+	}
 	if err != nil {
 		return nil, err
 	}
-	p, err := s.store.Read(pos)
+	return s.readAt(pos, off)
+}
+
+// readRange calls fn with the records of the segment from the given offset
+// in order, until fn returns false. It returns false if fn did.
+func (s *segment) readRange(off uint64, fn func(record *api.Record) bool) (bool, error) {
+	if off < s.baseOffset {
+		off = s.baseOffset
+	}
+	var prev uint64
+	start := s.index.Find(uint32(off - s.baseOffset))
+	for i := start; i < s.index.size/entWidth; i++ {
+		rel, pos := s.index.entry(i)
+		// Each batch is read once for all of its records.
+		if i > start && pos == prev {
+			continue
+		}
+		prev = pos
+		records, err := s.readBatch(pos, s.baseOffset+uint64(rel))
+		if err != nil {
+			return false, err
+		}
+		for _, record := range records {
+			if record.Offset >= off && !fn(record) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// readAt reads the record with the given offset from the batch at
+// the store position.
+func (s *segment) readAt(pos, off uint64) (*api.Record, error) {
+	records, err := s.readBatch(pos, off)
 	if err != nil {
 		return nil, err
 	}
-	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	for _, record := range records {
+		if record.Offset == off {
+			return record, nil
+		}
+	}
+	return nil, api.ErrCorruptRecord{Offset: off}
+}
+
+// readBatch reads the records of the batch at the store position,
+// which holds the record with the given offset.
+func (s *segment) readBatch(pos, off uint64) ([]*api.Record, error) {
+	records, _, err := s.readFrame(pos)
+	if err == errCorruptFrame {
+		return nil, api.ErrCorruptRecord{Offset: off}
+	}
+	return records, err
+}
+
+// readFrame reads the records of the frame at the store position and
+// returns the position of the next frame.
+func (s *segment) readFrame(pos uint64) ([]*api.Record, uint64, error) {
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	records, err := decodeBatch(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	return records, pos + headerWidth + uint64(len(p)), nil
+}
+
+// frames calls fn with the relative offset and store position of the first
+// record of each batch in the segment.
+func (s *segment) frames(fn func(rel uint32, pos uint64) error) error {
+	for i := uint64(0); i < s.index.size/entWidth; i++ {
+		rel, pos := s.index.entry(i)
+		// The records of a batch share its position.
+		if i > 0 {
+			if _, prev := s.index.entry(i - 1); prev == pos {
+				continue
+			}
+		}
+		if err := fn(rel, pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn with the records of every batch in the segment.
+func (s *segment) scan(fn func(records []*api.Record) error) error {
+	return s.frames(func(rel uint32, pos uint64) error {
+		records, err := s.readBatch(pos, s.baseOffset+uint64(rel))
+		if err != nil {
+			return err
+		}
+		return fn(records)
+	})
+}
+
+// size returns the number of bytes of the segment's records and of the entries
+// of its offset and time indexes.
+func (s *segment) size() uint64 {
+	return s.store.size + s.index.size + s.timeIndex.size
+}
+
+// fits returns true if the index has room for n more records.
+func (s *segment) fits(n int) bool {
+	return uint64(len(s.index.mmap)) >= s.index.size+uint64(n)*entWidth
 }
 
 // IsMaxed returns true if the segment has reached its maximum size.
@@ -88,6 +291,17 @@ func (s *segment) IsMaxed() bool {
 		s.index.isMaxed()
 }
 
+// Sync commits the segment's store and index to stable storage.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.timeIndex.Sync()
+}
+
 // Remove deletes the segment's store and index files.
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
@@ -96,6 +310,9 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
@@ -107,6 +324,9 @@ func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
@@ -7,7 +7,6 @@ import (
 
 	api "github.com/sota0121/proglog/api/v1"
 	"github.com/stretchr/testify/require"
-	"google.golang.org/protobuf/proto"
 )
 
 // TestSegment tests the segment.
@@ -44,17 +43,22 @@ func TestSegment(t *testing.T) {
 	}
 
 	// Additional append should fail because the segment is maxed.
+	// Nothing is written to the store in that case.
+	storeSize := s.store.size
 	_, err = s.Append(want)
 	require.Equal(t, io.EOF, err)
+	require.Equal(t, storeSize, s.store.size)
 
 	// The segment should be maxed because the index is maxed.
 	require.True(t, s.IsMaxed())
+	// Its size counts the entries of both indexes.
+	require.NotZero(t, s.timeIndex.size)
+	require.Equal(t, storeSize+numOfEntries*entWidth+s.timeIndex.size, s.size())
 	require.NoError(t, s.Close())
 
 	// ======== Test case 2 ========
 	// Restructure the segment so that store is maxed but index is not.
-	p, _ := proto.Marshal(want)
-	c.Segment.MaxStoreBytes = uint64(len(p)+lenWidth) * (numOfEntries + 1)
+	c.Segment.MaxStoreBytes = storeSize
 	c.Segment.MaxIndexBytes = 1024
 
 	s, err = newSegment(dir, baseOffset, c)
@@ -73,3 +77,71 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 	require.NoError(t, s.Close())
 }
+
+// TestSegmentCorruption tests that a damaged record is reported as corrupt.
+func TestSegmentCorruption(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment_corruption_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, s.store.buf.Flush())
+
+	// Flip a bit in the value of the record.
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, headerWidth+2)
+	require.NoError(t, err)
+	b[0] ^= 0x01
+	_, err = f.WriteAt(b, headerWidth+2)
+	require.NoError(t, err)
+
+	_, err = s.Read(off)
+	require.Equal(t, api.ErrCorruptRecord{Offset: off}, err)
+	require.NoError(t, s.Close())
+}
+
+// TestSegmentAppendBatch tests that a batch is appended only if
+// the index has room for all of its records.
+func TestSegmentAppendBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment_batch_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	off, err := s.AppendBatch([]*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	got, err := s.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), got.Value)
+	require.Equal(t, got.Timestamp.AsTime(), s.newest)
+
+	// The index has room for one more record only.
+	size := s.store.size
+	_, err = s.AppendBatch([]*api.Record{
+		{Value: []byte("third")},
+		{Value: []byte("fourth")},
+	})
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, size, s.store.size)
+	require.Equal(t, uint64(2), s.nextOffset)
+	require.NoError(t, s.Close())
+}
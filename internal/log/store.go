@@ -3,16 +3,26 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"os"
 	"sync"
 )
 
 var (
 	enc = binary.BigEndian
+
+	// crcTable is the CRC32C (Castagnoli) table used to checksum records.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errCorruptFrame is returned when a stored frame fails its integrity check.
+	errCorruptFrame = errors.New("store: corrupt frame")
 )
 
 const (
-	lenWidth = 8 // bytes
+	lenWidth    = 8                   // bytes
+	crcWidth    = 4                   // bytes
+	headerWidth = lenWidth + crcWidth // bytes
 )
 
 type store struct {
@@ -37,6 +47,7 @@ func newStore(f *os.File) (*store, error) {
 }
 
 // Append appends a record to the store.
+// Each record is stored as a frame: [length][CRC32C of the record][record].
 // this method returns the offset of the record.
 // n: the length of the buffer
 // pos: the offset of the record
@@ -51,20 +62,26 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 		return 0, 0, err
 	}
 
+	// Write the checksum of the record.
+	if err := binary.Write(s.buf, enc, crc32.Checksum(p, crcTable)); err != nil {
+		return 0, 0, err
+	}
+
 	// Write the record.
 	w, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	// the size of record is record + meta (len of record)
-	w += lenWidth
+	// the size of record is record + meta (len and checksum of record)
+	w += headerWidth
 
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
 // Read reads a record from the store with the given offset.
+// It returns errCorruptFrame if the record does not match its checksum.
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -75,17 +92,31 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 
-	// Read the length of the record.
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	// Read the length and the checksum of the record.
+	header := make([]byte, headerWidth)
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
 		return nil, err
 	}
+	size := enc.Uint64(header[:lenWidth])
+	sum := enc.Uint32(header[lenWidth:])
+
+	// A corrupted length must not make us read beyond the end of the store.
+	// Nothing appends an empty record, so a zero length is zero-filled space,
+	// whose zero checksum would otherwise match.
+	if size == 0 || size > s.size-pos-headerWidth {
+		return nil, errCorruptFrame
+	}
 
 	// Read the record using the record size from the previous step.
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	b := make([]byte, size)
+	if _, err := s.File.ReadAt(b, int64(pos+headerWidth)); err != nil {
 		return nil, err
 	}
+
+	// Verify the record against its checksum.
+	if crc32.Checksum(b, crcTable) != sum {
+		return nil, errCorruptFrame
+	}
 	return b, nil
 }
 
@@ -105,6 +136,36 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// Sync flushes the buffer and commits the store to stable storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	// Flush the buffer before syncing.
+	err := s.buf.Flush()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Appends may continue while the file is synced.
+	return s.File.Sync()
+}
+
+// Truncate discards everything in the store from the given position.
+func (s *store) Truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Flush the buffer before truncating.
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	return nil
+}
+
 // Close closes the store.
 func (s *store) Close() error {
 	s.mu.Lock()
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"hash/crc32"
 	"os"
 	"testing"
 
@@ -8,9 +9,9 @@ import (
 )
 
 var (
-	write       = []byte("hello world")         // the data to write
-	width       = uint64(len(write)) + lenWidth // the length of the record
-	numOfRecord = uint64(3)                     // the number of records
+	write       = []byte("hello world")            // the data to write
+	width       = uint64(len(write)) + headerWidth // the length of the record
+	numOfRecord = uint64(3)                        // the number of records
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -62,22 +63,61 @@ func testReadAt(t *testing.T, s *store) {
 	t.Helper() // mark this function as a helper function
 
 	for i, off := uint64(1), int64(0); i < (numOfRecord + 1); i++ {
-		b := make([]byte, lenWidth)
-		n, err := s.ReadAt(b, off) // read the length of the record
+		b := make([]byte, headerWidth)
+		n, err := s.ReadAt(b, off) // read the length and the checksum of the record
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, headerWidth, n)
 		off += int64(n)
 
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:lenWidth])
+		sum := enc.Uint32(b[lenWidth:])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off) // read the record
 		require.NoError(t, err)
 		require.Equal(t, write, b)
 		require.Equal(t, size, uint64(n))
+		require.Equal(t, crc32.Checksum(write, crcTable), sum)
 		off += int64(n)
 	}
 }
 
+func TestStoreCorruption(t *testing.T) {
+	// Create a temporary file.
+	f, err := os.CreateTemp("", "store_corruption_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.buf.Flush())
+
+	// Flip a bit in the second record.
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(width+headerWidth))
+	require.NoError(t, err)
+	b[0] ^= 0x01
+	_, err = f.WriteAt(b, int64(width+headerWidth))
+	require.NoError(t, err)
+
+	// The other records are still readable.
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	// The damaged record fails its checksum.
+	_, err = s.Read(width)
+	require.Equal(t, errCorruptFrame, err)
+
+	// A corrupted length is detected as well.
+	b = make([]byte, lenWidth)
+	enc.PutUint64(b, 1<<40)
+	_, err = f.WriteAt(b, int64(width*2))
+	require.NoError(t, err)
+	_, err = s.Read(width * 2)
+	require.Equal(t, errCorruptFrame, err)
+}
+
 func TestStoreClose(t *testing.T) {
 	// Create a temporary file.
 	f, err := os.CreateTemp("", "store_close_test")
@@ -0,0 +1,82 @@
+package log
+
+import (
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// timeIndex is a sparse memory-mapped index from the append times of a
+// segment's records to their offsets. It shares the entry layout of index,
+// keeping the append time in Unix nanoseconds in place of the store position.
+// An entry is written for the first record, and then for the first record
+// after every Config.Segment.TimeIndexIntervalBytes of store data.
+type timeIndex struct {
+	*index
+	interval uint64 // store bytes between indexed records
+	lastPos  uint64 // store position of the last indexed record
+}
+
+// newTimeIndex creates a new time index for the given file.
+func newTimeIndex(f *os.File, c Config) (*timeIndex, error) {
+	idx, err := newIndex(f, c)
+	if err != nil {
+		return nil, err
+	}
+	return &timeIndex{
+		index:    idx,
+		interval: c.Segment.TimeIndexIntervalBytes,
+	}, nil
+}
+
+// Write indexes the append time of the record with the given relative offset
+// and store position, unless the last indexed record is too close.
+func (t *timeIndex) Write(off uint32, pos uint64, ts time.Time) error {
+	if t.size > 0 && pos-t.lastPos < t.interval {
+		return nil
+	}
+	// The index is sparse, so a missing entry only makes lookups scan further.
+	if t.isMaxed() {
+		return nil
+	}
+	if err := t.index.Write(off, uint64(unixNano(ts))); err != nil {
+		return err
+	}
+	t.lastPos = pos
+	return nil
+}
+
+// Lookup returns the relative offset of the last indexed record appended
+// before the given time. ok is false if there is no such record.
+func (t *timeIndex) Lookup(ts time.Time) (off uint32, ok bool) {
+	n := t.size / entWidth
+	target := unixNano(ts)
+	i := sort.Search(int(n), func(i int) bool {
+		_, at := t.entry(uint64(i))
+		return int64(at) >= target
+	})
+	if i == 0 {
+		return 0, false
+	}
+	off, _ = t.entry(uint64(i - 1))
+	return off, true
+}
+
+var (
+	minUnixNano = time.Unix(0, math.MinInt64)
+	maxUnixNano = time.Unix(0, math.MaxInt64)
+)
+
+// unixNano returns the time in Unix nanoseconds, clamped to the range of
+// int64, so that times before 1970 or out of range still sort in order.
+// The entries of the time index keep it as the bits of a uint64.
+func unixNano(ts time.Time) int64 {
+	switch {
+	case ts.Before(minUnixNano):
+		return math.MinInt64
+	case ts.After(maxUnixNano):
+		return math.MaxInt64
+	}
+	return ts.UnixNano()
+}
@@ -0,0 +1,67 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// Create a new time index which indexes a record every 100 bytes.
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.TimeIndexIntervalBytes = 100
+	idx, err := newTimeIndex(f, c)
+	require.NoError(t, err)
+
+	// Nothing is indexed yet.
+	start := time.Unix(1000, 0)
+	_, ok := idx.Lookup(start)
+	require.False(t, ok)
+
+	// Write a record of 40 bytes every second.
+	for i := 0; i < 10; i++ {
+		err = idx.Write(uint32(i), uint64(i*40), start.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+	}
+	// Only the records at 0, 120, 240 and 360 bytes are indexed.
+	require.Equal(t, 4*entWidth, idx.size)
+
+	tests := []struct {
+		at     time.Duration
+		off    uint32
+		exists bool
+	}{
+		{at: 0, exists: false},
+		{at: time.Second, off: 0, exists: true},
+		{at: 3 * time.Second, off: 0, exists: true},
+		{at: 4 * time.Second, off: 3, exists: true},
+		{at: 100 * time.Second, off: 9, exists: true},
+	}
+	for _, tc := range tests {
+		off, ok := idx.Lookup(start.Add(tc.at))
+		require.Equal(t, tc.exists, ok, "lookup at %v", tc.at)
+		require.Equal(t, tc.off, off, "lookup at %v", tc.at)
+	}
+
+	// Times before 1970 or out of the range of Unix nanoseconds
+	// come before every entry, or after them.
+	for _, at := range []time.Time{
+		time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC),
+		{},
+	} {
+		_, ok := idx.Lookup(at)
+		require.False(t, ok, "lookup at %v", at)
+	}
+	off, ok := idx.Lookup(time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC))
+	require.True(t, ok)
+	require.Equal(t, uint32(9), off)
+	require.NoError(t, idx.Close())
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/sota0121/proglog/api/v1"
+	"github.com/sota0121/proglog/internal/auth"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestAuthorization tests that clients only do what the policy permits them to.
+func TestAuthorization(t *testing.T) {
+	dir, err := os.MkdirTemp("", "auth-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.csv")
+	require.NoError(t, os.WriteFile(policyFile, []byte("p, root, *\np, reader, consume\n"), 0600))
+	authorizer, err := auth.New(policyFile)
+	require.NoError(t, err)
+
+	ca := newTestCA(t, dir, "ca")
+	addr := setupConfigTest(t, &Config{
+		TLS:        ca.serverTLS(t, true),
+		Authorizer: authorizer,
+	})
+	client := func(cn string) api.LogClient {
+		certFile, keyFile := ca.issue(t, cn, false)
+		creds, err := ClientCredentials(ca.file, certFile, keyFile)
+		require.NoError(t, err)
+		cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() })
+		return api.NewLogClient(cc)
+	}
+	root, reader, nobody := client("root"), client("reader"), client("nobody")
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+
+	// root may do anything.
+	produce, err := root.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+	_, err = root.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+
+	// reader may consume only.
+	_, err = reader.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	_, err = reader.ConsumeRange(ctx, &api.ConsumeRangeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	_, err = reader.Produce(ctx, &api.ProduceRequest{Record: record})
+	requireDenied(t, err, "reader")
+	_, err = reader.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: []*api.Record{record}})
+	requireDenied(t, err, "reader")
+	produceStream, err := reader.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, produceStream.Send(&api.ProduceRequest{Record: record}))
+	_, err = produceStream.Recv()
+	requireDenied(t, err, "reader")
+
+	// nobody may do nothing.
+	_, err = nobody.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	requireDenied(t, err, "nobody")
+	consumeStream, err := nobody.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = consumeStream.Recv()
+	requireDenied(t, err, "nobody")
+}
+
+func requireDenied(t *testing.T, err error, subject string) {
+	t.Helper()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), subject)
+}
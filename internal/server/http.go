@@ -1,19 +1,29 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	api "github.com/sota0121/proglog/api/v1"
+	"google.golang.org/grpc/status"
 )
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+// NewHTTPServer initializes a JSON API server which appends to
+// and reads from the commit log of the config.
+func NewHTTPServer(addr string, config *Config) *http.Server {
+	httpsrv := newHTTPServer(config)
 
 	// Register routes.
 	r := mux.NewRouter()
 	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
 	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
+	if config.TokenVerifier != nil {
+		r.Use(httpsrv.authenticate)
+	}
 
 	return &http.Server{
 		Addr:    addr,
@@ -21,18 +31,70 @@ func NewHTTPServer(addr string) *http.Server {
 	}
 }
 
+// TokenVerifier is the interface for the authentication of the clients
+// of the JSON API. Verify returns the subject of a bearer token, which
+// the Authorizer of the config then authorizes like a client certificate.
+// internal/auth/token.go->Tokens and JWTVerifier implement this interface.
+type TokenVerifier interface {
+	Verify(token string) (subject string, err error)
+}
+
 type httpServer struct {
-	Log *Log
+	*Config
 }
 
-func newHTTPServer() *httpServer {
+func newHTTPServer(config *Config) *httpServer {
 	return &httpServer{
-		Log: NewLog(),
+		Config: config,
 	}
 }
 
+// subjectKey is the context key of the subject of a request.
+type subjectKey struct{}
+
+// authenticate rejects the requests without a valid bearer token and
+// passes the subject of the token on to the handlers.
+func (s *httpServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject, ok := s.verify(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proglog"`)
+			http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), subjectKey{}, subject)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// verify returns the subject of the bearer token of the request
+// and whether the token is valid.
+func (s *httpServer) verify(r *http.Request) (string, bool) {
+	const scheme = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, scheme) {
+		return "", false
+	}
+	subject, err := s.TokenVerifier.Verify(header[len(scheme):])
+	return subject, err == nil
+}
+
+// authorize returns nil if the client of the request may perform the action.
+// Without a TokenVerifier, the subject of every request is "".
+func (s *httpServer) authorize(r *http.Request, action string) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+	subject, _ := r.Context().Value(subjectKey{}).(string)
+	return s.Authorizer.Authorize(subject, action)
+}
+
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	if err := s.authorize(r, produceAction); err != nil {
+		http.Error(w, status.Convert(err).Message(), http.StatusForbidden)
+		return
+	}
 
 	var req ProduceRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -40,9 +102,13 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	off, err := s.Log.Append(req.Record)
+	off, err := s.CommitLog.Append(&api.Record{
+		Value:     req.Record.Value,
+		Key:       req.Record.Key,
+		Tombstone: req.Record.Tombstone,
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 
@@ -56,6 +122,10 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 
 func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	if err := s.authorize(r, consumeAction); err != nil {
+		http.Error(w, status.Convert(err).Message(), http.StatusForbidden)
+		return
+	}
 
 	var req ConsumeRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -63,17 +133,40 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var maxWait time.Duration
+	if req.MaxWait != "" {
+		maxWait, err = time.ParseDuration(req.MaxWait)
+		if err != nil || maxWait < 0 {
+			http.Error(w, "max_wait must be a duration such as \"5s\"", http.StatusBadRequest)
+			return
+		}
+	}
+	record, err := s.CommitLog.Read(req.Offset)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok && maxWait > 0 {
+		// Long-poll for the record like grpcServer.Consume. If it isn't
+		// appended in time, the request fails as if it hadn't waited.
+		ctx, cancel := s.drainContext(r.Context())
+		defer cancel()
+		ctx, cancel = context.WithTimeout(ctx, maxWait)
+		defer cancel()
+		if s.CommitLog.Wait(ctx, req.Offset) == nil {
+			record, err = s.CommitLog.Read(req.Offset)
+		} else if s.draining() {
+			http.Error(w, status.Convert(errDraining).Message(), http.StatusServiceUnavailable)
+			return
+		}
 	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 
-	resp := ConsumeResponse{Record: record}
+	resp := ConsumeResponse{Record: Record{
+		Value:     record.Value,
+		Offset:    record.Offset,
+		Key:       record.Key,
+		Tombstone: record.Tombstone,
+	}}
 	err = json.NewEncoder(w).Encode(resp)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -81,6 +174,18 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// httpStatus returns the HTTP status code of an error of the commit log.
+func httpStatus(err error) int {
+	switch err.(type) {
+	case api.ErrInvalidRecord:
+		return http.StatusBadRequest
+	case api.ErrOffsetOutOfRange, api.ErrOffsetCompacted:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 type ProduceRequest struct {
 	Record Record `json:"record"`
 }
@@ -91,8 +196,19 @@ type ProduceResponse struct {
 
 type ConsumeRequest struct {
 	Offset uint64 `json:"offset"`
+	// MaxWait is how long to wait for the record to be appended if it
+	// is past the end of the log, as a duration such as "5s".
+	MaxWait string `json:"max_wait,omitempty"`
 }
 
 type ConsumeResponse struct {
 	Record Record `json:"record"`
 }
+
+// Record is a single log record of the JSON API.
+type Record struct {
+	Value     []byte `json:"value"`
+	Offset    uint64 `json:"offset"`
+	Key       []byte `json:"key,omitempty"`
+	Tombstone bool   `json:"tombstone,omitempty"`
+}
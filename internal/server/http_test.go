@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sota0121/proglog/internal/auth"
+	"github.com/sota0121/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPServer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := NewHTTPServer(":0", &Config{CommitLog: clog})
+
+	// do sends the JSON request to the server and decodes its response.
+	do := func(method string, req, resp interface{}) int {
+		t.Helper()
+		b, err := json.Marshal(req)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, "/", bytes.NewReader(b)))
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+		}
+		return w.Code
+	}
+
+	// Produce a record to the log on disk.
+	var produce ProduceResponse
+	code := do("POST", ProduceRequest{Record: Record{Value: []byte("hello world")}}, &produce)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, uint64(0), produce.Offset)
+	off, err := clog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// Consume it back.
+	var consume ConsumeResponse
+	code = do("GET", ConsumeRequest{Offset: produce.Offset}, &consume)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+	require.Equal(t, produce.Offset, consume.Record.Offset)
+
+	// Errors of the log map to HTTP status codes.
+	code = do("GET", ConsumeRequest{Offset: 1}, &consume)
+	require.Equal(t, http.StatusNotFound, code)
+	code = do("POST", ProduceRequest{Record: Record{Tombstone: true}}, &produce)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Consuming past the end waits up to max_wait.
+	start := time.Now()
+	code = do("GET", ConsumeRequest{Offset: 1, MaxWait: "50ms"}, &consume)
+	require.Equal(t, http.StatusNotFound, code)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	code = do("GET", ConsumeRequest{Offset: 1, MaxWait: "soon"}, &consume)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// A waiting consumer receives the record once it is produced.
+	b, err := json.Marshal(ConsumeRequest{Offset: 1, MaxWait: "5s"})
+	require.NoError(t, err)
+	consumed := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/", bytes.NewReader(b)))
+		consumed <- w
+	}()
+	code = do("POST", ProduceRequest{Record: Record{Value: []byte("second message")}}, &produce)
+	require.Equal(t, http.StatusOK, code)
+	w := <-consumed
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&consume))
+	require.Equal(t, []byte("second message"), consume.Record.Value)
+}
+
+// TestHTTPAuth tests that the JSON API authenticates bearer tokens
+// and authorizes their subjects.
+func TestHTTPAuth(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-auth-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "log"), 0755))
+	clog, err := log.NewLog(filepath.Join(dir, "log"), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	policyFile := filepath.Join(dir, "policy.csv")
+	require.NoError(t, os.WriteFile(policyFile, []byte("p, root, *\np, reader, consume\n"), 0600))
+	authorizer, err := auth.New(policyFile)
+	require.NoError(t, err)
+	tokensFile := filepath.Join(dir, "tokens.csv")
+	require.NoError(t, os.WriteFile(tokensFile, []byte("root-token, root\nreader-token, reader\n"), 0600))
+	tokens, err := auth.LoadTokens(tokensFile)
+	require.NoError(t, err)
+
+	srv := NewHTTPServer(":0", &Config{
+		CommitLog:     clog,
+		Authorizer:    authorizer,
+		TokenVerifier: tokens,
+	})
+
+	// do sends the JSON request with the authorization header to the server.
+	do := func(method, authorization string, req interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		b, err := json.Marshal(req)
+		require.NoError(t, err)
+		r := httptest.NewRequest(method, "/", bytes.NewReader(b))
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, r)
+		return w
+	}
+	produce := ProduceRequest{Record: Record{Value: []byte("hello world")}}
+	consume := ConsumeRequest{Offset: 0}
+
+	// root may do anything.
+	require.Equal(t, http.StatusOK, do("POST", "Bearer root-token", produce).Code)
+	require.Equal(t, http.StatusOK, do("GET", "Bearer root-token", consume).Code)
+
+	// reader may consume only.
+	require.Equal(t, http.StatusOK, do("GET", "Bearer reader-token", consume).Code)
+	w := do("POST", "Bearer reader-token", produce)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, w.Body.String(), "reader")
+
+	// Unknown and missing tokens are rejected.
+	for _, authorization := range []string{"Bearer guess", "root-token", ""} {
+		w := do("GET", authorization, consume)
+		require.Equal(t, http.StatusUnauthorized, w.Code, authorization)
+		require.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+	}
+
+	// Without tokens, the clients are anonymous and even a policy
+	// for any subject doesn't permit them anything.
+	require.NoError(t, os.WriteFile(policyFile, []byte("p, *, consume\n"), 0600))
+	authorizer, err = auth.New(policyFile)
+	require.NoError(t, err)
+	srv = NewHTTPServer(":0", &Config{
+		CommitLog:  clog,
+		Authorizer: authorizer,
+	})
+	w = do("GET", "", consume)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, w.Body.String(), "anonymous")
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	api "github.com/sota0121/proglog/api/v1"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics are the Prometheus metrics of the requests to the gRPC server.
+type Metrics struct {
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// NewMetrics creates the metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "grpc",
+			Name:      "requests_total",
+			Help:      "Number of requests served, by method and status code.",
+		}, []string{"method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "proglog",
+			Subsystem: "grpc",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to serve the requests, by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+	}
+	for _, c := range []prometheus.Collector{m.requests, m.latency} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// observer logs, measures and traces the requests to the gRPC server
+// as configured. Its interceptors run around every handler.
+type observer struct {
+	logger  *zap.Logger
+	metrics *Metrics
+	tracer  trace.Tracer
+}
+
+// newObserver returns the observer of the config, or nil if the config
+// neither logs, measures nor traces the requests.
+func newObserver(config *Config) *observer {
+	if config.Logger == nil && config.Metrics == nil && config.TracerProvider == nil {
+		return nil
+	}
+	o := &observer{
+		logger:  config.Logger,
+		metrics: config.Metrics,
+	}
+	if o.logger == nil {
+		o.logger = zap.NewNop()
+	}
+	tp := config.TracerProvider
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	o.tracer = tp.Tracer("github.com/sota0121/proglog/internal/server")
+	return o
+}
+
+// start starts observing a request. The returned function ends it with
+// the offset of the request, if any, and the error which it failed with.
+func (o *observer) start(ctx context.Context, method string) (context.Context, func(offset uint64, hasOffset bool, err error)) {
+	begin := time.Now()
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		addr = p.Addr.String()
+	}
+	ctx, span := o.tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+			attribute.String("net.peer.addr", addr),
+		),
+	)
+
+	return ctx, func(offset uint64, hasOffset bool, err error) {
+		latency := time.Since(begin)
+		code := status.Code(err)
+
+		fields := []zap.Field{
+			zap.String("method", method),
+			zap.String("peer", addr),
+			zap.Duration("latency", latency),
+			zap.String("code", code.String()),
+		}
+		if hasOffset {
+			fields = append(fields, zap.Uint64("offset", offset))
+			span.SetAttributes(attribute.Int64("log.offset", int64(offset)))
+		}
+		if err != nil {
+			o.logger.Warn("request failed", append(fields, zap.Error(err))...)
+		} else {
+			o.logger.Info("request served", fields...)
+		}
+
+		if o.metrics != nil {
+			o.metrics.requests.WithLabelValues(method, code.String()).Inc()
+			o.metrics.latency.WithLabelValues(method).Observe(latency.Seconds())
+		}
+
+		span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(code)))
+		if code != codes.OK {
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+		}
+		span.End()
+	}
+}
+
+// unaryInterceptor observes the unary requests.
+func (o *observer) unaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, finish := o.start(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	offset, ok := uint64(0), false
+	if err == nil {
+		offset, ok = offsetOf(resp)
+	}
+	if !ok {
+		offset, ok = offsetOf(req)
+	}
+	finish(offset, ok, err)
+	return resp, err
+}
+
+// streamInterceptor observes the streams. The offset of a stream is
+// the last one which it received or sent.
+func (o *observer) streamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, finish := o.start(ss.Context(), info.FullMethod)
+	stream := &observedStream{ServerStream: ss, ctx: ctx}
+	err := handler(srv, stream)
+	finish(stream.offset, stream.hasOffset, err)
+	return err
+}
+
+// observedStream keeps track of the offsets of a stream.
+type observedStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	offset    uint64
+	hasOffset bool
+}
+
+func (s *observedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *observedStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.track(m)
+	}
+	return err
+}
+
+func (s *observedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.track(m)
+	}
+	return err
+}
+
+func (s *observedStream) track(m interface{}) {
+	if offset, ok := offsetOf(m); ok {
+		s.offset, s.hasOffset = offset, true
+	}
+}
+
+// offsetOf returns the offset of a request or a response of the log service.
+func offsetOf(m interface{}) (uint64, bool) {
+	switch m := m.(type) {
+	case *api.ProduceResponse:
+		return m.GetOffset(), m != nil
+	case *api.ProduceBatchResponse:
+		if len(m.GetOffsets()) > 0 {
+			return m.Offsets[0], true
+		}
+	case *api.ConsumeRequest:
+		return m.GetOffset(), m != nil
+	case *api.ConsumeResponse:
+		return m.GetRecord().GetOffset(), m.GetRecord() != nil
+	case *api.ConsumeRangeRequest:
+		return m.GetOffset(), m != nil
+	}
+	return 0, false
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	api "github.com/sota0121/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	zapobserver "go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestInterceptors tests that the requests are logged, measured and traced.
+func TestInterceptors(t *testing.T) {
+	core, logs := zapobserver.New(zapcore.InfoLevel)
+	metrics, err := NewMetrics(prometheus.NewRegistry())
+	require.NoError(t, err)
+	spans := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Logger = zap.New(core)
+		c.Metrics = metrics
+		c.TracerProvider = tp
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// Act - produce twice, consume past the end and follow the log
+	for i := 0; i < 2; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	cancel()
+	// The stream is observed once its handler returns.
+	require.Eventually(t, func() bool { return logs.Len() == 4 }, 5*time.Second, 10*time.Millisecond)
+
+	// Assert - logs
+	entries := logs.AllUntimed()
+	produce := entries[1].ContextMap()
+	require.Equal(t, "/log.v1.Log/Produce", produce["method"])
+	require.Equal(t, "OK", produce["code"])
+	require.Equal(t, uint64(1), produce["offset"])
+	require.NotEmpty(t, produce["peer"])
+	require.Contains(t, produce, "latency")
+	consume := entries[2].ContextMap()
+	require.Equal(t, zapcore.WarnLevel, entries[2].Level)
+	require.Equal(t, "OutOfRange", consume["code"])
+	require.Equal(t, uint64(2), consume["offset"])
+	require.Equal(t, "/log.v1.Log/ConsumeStream", entries[3].ContextMap()["method"])
+	require.Equal(t, uint64(1), entries[3].ContextMap()["offset"])
+
+	// Assert - metrics
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.requests.WithLabelValues("/log.v1.Log/Produce", "OK")))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.requests.WithLabelValues("/log.v1.Log/Consume", "OutOfRange")))
+	require.Equal(t, 3, testutil.CollectAndCount(metrics.latency))
+
+	// Assert - spans
+	ended := spans.Ended()
+	require.Len(t, ended, 4)
+	require.Equal(t, "/log.v1.Log/Consume", ended[2].Name())
+	require.Equal(t, otelcodes.Error, ended[2].Status().Code)
+	require.Contains(t, ended[2].Attributes(), attribute.Int64("log.offset", 2))
+	require.Equal(t, otelcodes.Unset, ended[1].Status().Code)
+	require.Contains(t, ended[1].Attributes(), attribute.Int64("log.offset", 1))
+}
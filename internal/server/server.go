@@ -2,17 +2,50 @@ package server
 
 import (
 	"context"
+	"time"
 
 	api "github.com/sota0121/proglog/api/v1"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 type Config struct {
 	CommitLog CommitLog
+	// Drain is closed when the server shuts down. Streams and long polls
+	// then end with codes.Unavailable, so that clients reconnect elsewhere.
+	Drain <-chan struct{}
+	// TLS, if set, makes the gRPC server accept TLS connections only.
+	TLS *TLSConfig
+	// Authorizer, if set, decides which clients may produce and consume.
+	// A client of the gRPC server is identified by the common name of its
+	// certificate, and a client of the JSON API by its bearer token.
+	Authorizer Authorizer
+	// TokenVerifier, if set, makes the JSON API require bearer tokens.
+	TokenVerifier TokenVerifier
+
+	// Logger, if set, logs every request to the gRPC server with
+	// its method, peer, latency, status code and offset.
+	Logger *zap.Logger
+	// Metrics, if set, counts and times the requests to the gRPC server.
+	Metrics *Metrics
+	// TracerProvider, if set, traces every request to the gRPC server.
+	TracerProvider trace.TracerProvider
 }
 
 var _ api.LogServer = (*grpcServer)(nil) // grpcServer implements api.LogServer
 
+// defaultMaxBytes bounds the size of a ConsumeRange response well below
+// the gRPC message size limit of 4 MiB.
+const defaultMaxBytes = 1 << 20
+
+// errDraining tells the clients to retry once the server is back.
+var errDraining = status.Error(codes.Unavailable, "server is shutting down")
+
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
@@ -23,12 +56,42 @@ type grpcServer struct {
 // This is the Dependency Inversion Principle.
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	ReadRange(off uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error)
+	OffsetForTime(time.Time) (uint64, error)
+	Wait(ctx context.Context, off uint64) error
+}
+
+// Authorizer is the interface for the authorization of the clients.
+// internal/auth/authorizer.go->Authorizer implements this interface.
+type Authorizer interface {
+	Authorize(subject, action string) error
 }
 
+// The actions of the clients which an Authorizer permits.
+const (
+	produceAction = "produce"
+	consumeAction = "consume"
+)
+
 // NewGRPCServer initializes a new gRPC server.
 func NewGRPCServer(config *Config) (*grpc.Server, error) {
-	gsrv := grpc.NewServer()
+	var opts []grpc.ServerOption
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.ServerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if o := newObserver(config); o != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(o.unaryInterceptor),
+			grpc.ChainStreamInterceptor(o.streamInterceptor),
+		)
+	}
+	gsrv := grpc.NewServer(opts...)
 	srv, err := newgrpcServer(config)
 	if err != nil {
 		return nil, err
@@ -45,6 +108,9 @@ func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
 	offset, err := s.CommitLog.Append(req.Record)
 	if err != nil {
 		return nil, err
@@ -52,20 +118,100 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+// ProduceBatch appends all the records of the request to the log or none of them.
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
+	offset, err := s.CommitLog.AppendBatch(req.Records)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, len(req.Records))
+	for i := range offsets {
+		offsets[i] = offset + uint64(i)
+	}
+	return &api.ProduceBatchResponse{Offsets: offsets}, nil
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if err := s.resolveStartTime(req); err != nil {
+		return nil, err
+	}
 	record, err := s.CommitLog.Read(req.Offset)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok && req.MaxWait != nil {
+		// Long-poll for the record. If it isn't appended in time,
+		// the request fails as if it hadn't waited.
+		ctx, cancel := s.drainContext(ctx)
+		defer cancel()
+		ctx, cancel = context.WithTimeout(ctx, req.MaxWait.AsDuration())
+		defer cancel()
+		if s.CommitLog.Wait(ctx, req.Offset) == nil {
+			record, err = s.CommitLog.Read(req.Offset)
+		} else if s.draining() {
+			return nil, errDraining
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// ConsumeRange returns the records from the requested offset within its limits.
+func (s *grpcServer) ConsumeRange(ctx context.Context, req *api.ConsumeRangeRequest) (*api.ConsumeRangeResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	maxBytes := req.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMaxBytes
+	}
+	records, err := s.CommitLog.ReadRange(req.Offset, int(req.MaxRecords), maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeRangeResponse{Records: records}, nil
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	if err := s.authorize(stream.Context(), produceAction); err != nil {
+		return err
+	}
+	// Receive in the background, so that an idle stream ends
+	// as soon as the server drains.
+	type received struct {
+		req *api.ProduceRequest
+		err error
+	}
+	reqs := make(chan received)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			select {
+			case reqs <- received{req, err}:
+			case <-stream.Context().Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
 	for {
 		// Receive a ProduceRequest from the client.
-		req, err := stream.Recv()
-		if err != nil {
-			return err
+		var req *api.ProduceRequest
+		select {
+		case <-s.Drain:
+			return errDraining
+		case r := <-reqs:
+			if r.err != nil {
+				return r.err
+			}
+			req = r.req
 		}
 		// Append the record to the commit log.
 		res, err := s.Produce(stream.Context(), req)
@@ -83,15 +229,40 @@ func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	if err := s.authorize(stream.Context(), consumeAction); err != nil {
+		return err
+	}
+	// Resolve the start time once, then follow the offsets.
+	if err := s.resolveStartTime(req); err != nil {
+		return err
+	}
+	ctx, cancel := s.drainContext(stream.Context())
+	defer cancel()
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
+		case <-s.Drain:
+			return errDraining
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			res, err := s.Consume(ctx, req)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// Block until the record is appended.
+				err := s.CommitLog.Wait(ctx, req.Offset)
+				if s.draining() {
+					return errDraining
+				}
+				if stream.Context().Err() != nil {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			case api.ErrOffsetCompacted:
+				req.Offset++
 				continue
 			default:
 				return err
@@ -103,3 +274,63 @@ func (s *grpcServer) ConsumeStream(
 		}
 	}
 }
+
+// authorize returns nil if the client of the request may perform the action.
+func (s *grpcServer) authorize(ctx context.Context, action string) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+	return s.Authorizer.Authorize(subject(ctx), action)
+}
+
+// subject returns the common name of the certificate of the client,
+// or "" if it hasn't presented any.
+func subject(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+// drainContext returns a context which is also done when the server drains.
+func (c *Config) drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.Drain:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// draining returns true once the server shuts down.
+func (c *Config) draining() bool {
+	select {
+	case <-c.Drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolveStartTime replaces the start time of the request, if any,
+// with the offset of the first record appended at or after it.
+func (s *grpcServer) resolveStartTime(req *api.ConsumeRequest) error {
+	if req.StartTime == nil {
+		return nil
+	}
+	offset, err := s.CommitLog.OffsetForTime(req.StartTime.AsTime())
+	if err != nil {
+		return err
+	}
+	req.Offset = offset
+	req.StartTime = nil
+	return nil
+}
@@ -5,13 +5,16 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	api "github.com/sota0121/proglog/api/v1"
 	"github.com/sota0121/proglog/internal/log"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 func TestServer(t *testing.T) {
@@ -24,6 +27,12 @@ func TestServer(t *testing.T) {
 		"produce/consume a message to/from the log succeeds": testProduceConsume,
 		"produce/consume stream succeeds":                    testProduceConsumeStream,
 		"consume past log boundary fails":                    testConsumePastLogBoundary,
+		"consume from a start time succeeds":                 testConsumeStartTime,
+		"produce an invalid record fails":                    testProduceInvalidRecord,
+		"produce a batch of messages succeeds":               testProduceBatch,
+		"consume a range of messages succeeds":               testConsumeRange,
+		"consume stream waits for new messages":              testConsumeStreamWaits,
+		"consume waits up to max wait":                       testConsumeMaxWait,
 	}
 
 	// Run each test scenario.
@@ -36,6 +45,43 @@ func TestServer(t *testing.T) {
 	}
 }
 
+// TestServerDrain tests that streams and long polls end when the server drains.
+func TestServerDrain(t *testing.T) {
+	drain := make(chan struct{})
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Drain = drain
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// Arrange - follow the log with a stream
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	produceStream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+
+	// Act - drain while the streams wait for the next record
+	close(drain)
+
+	// Assert
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = produceStream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:  1,
+		MaxWait: durationpb.New(5 * time.Second),
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
 // setupTest creates a test server and client.
 func setupTest(t *testing.T, fn func(*Config)) (
 	client api.LogClient,
@@ -191,10 +237,9 @@ func testProduceConsumeStream(t *testing.T, client api.LogClient, config *Config
 			require.NoError(t, err)
 
 			// Assert - the received data must be the same as the sending data.
-			require.Equal(t, res.Record, &api.Record{
-				Value:  want.Value,
-				Offset: uint64(offset),
-			})
+			require.Equal(t, want.Value, res.Record.Value)
+			require.Equal(t, uint64(offset), res.Record.Offset)
+			require.NotNil(t, res.Record.Timestamp)
 		}
 	}
 }
@@ -223,3 +268,176 @@ func testConsumePastLogBoundary(t *testing.T, client api.LogClient, config *Conf
 		t.Fatalf("got %v, want %v", got, want)
 	}
 }
+
+func testConsumeStartTime(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// Arrange - produce messages and remember when the second was appended
+	for _, value := range []string{"first message", "second message"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+	second, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+
+	// Act - consume from the append time of the second message
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		StartTime: second.Record.Timestamp,
+	})
+
+	// Assert
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), consume.Record.Offset)
+	require.Equal(t, []byte("second message"), consume.Record.Value)
+}
+
+func testProduceInvalidRecord(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// Act - produce tombstones without a key and with a value
+	for _, record := range []*api.Record{
+		{Tombstone: true},
+		{Key: []byte("key"), Value: []byte("hello world"), Tombstone: true},
+	} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+
+		// Assert
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+
+	// A request without a record is rejected too.
+	_, err := client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// A tombstone with a key and no value is appended.
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Key: []byte("key"), Tombstone: true},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.True(t, consume.Record.Tombstone)
+}
+
+func testProduceBatch(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// Arrange
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+
+	// Act - produce the messages in one batch
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+
+	// Assert
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, produce.Offsets)
+	for i, want := range records {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offsets[i]})
+		require.NoError(t, err)
+		require.Equal(t, want.Value, consume.Record.Value)
+	}
+
+	// A batch with an invalid record is rejected as a whole.
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{{Value: []byte("fourth message")}, {Tombstone: true}},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func testConsumeRange(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// Arrange - produce messages
+	values := []string{"first message", "second message", "third message"}
+	for _, value := range values {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+
+	// Act - consume all the messages in one response
+	consume, err := client.ConsumeRange(ctx, &api.ConsumeRangeRequest{})
+
+	// Assert
+	require.NoError(t, err)
+	require.Len(t, consume.Records, len(values))
+	for i, record := range consume.Records {
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, []byte(values[i]), record.Value)
+	}
+
+	// The range is limited by the number of records.
+	consume, err = client.ConsumeRange(ctx, &api.ConsumeRangeRequest{Offset: 1, MaxRecords: 1})
+	require.NoError(t, err)
+	require.Len(t, consume.Records, 1)
+	require.Equal(t, uint64(1), consume.Records[0].Offset)
+
+	// A range past the log fails.
+	_, err = client.ConsumeRange(ctx, &api.ConsumeRangeRequest{Offset: 3})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func testConsumeStreamWaits(t *testing.T, client api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Arrange - subscribe before anything is produced
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+
+	// Act - produce a message
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	// Assert - the waiting stream receives it
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+}
+
+func testConsumeMaxWait(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// Act - consume at the end of the log without a producer
+	start := time.Now()
+	_, err := client.Consume(ctx, &api.ConsumeRequest{
+		MaxWait: durationpb.New(50 * time.Millisecond),
+	})
+
+	// Assert - the request fails once the wait expires
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// Act - produce a message while a consumer waits
+	var res *api.ConsumeResponse
+	consumed := make(chan error)
+	go func() {
+		var err error
+		res, err = client.Consume(ctx, &api.ConsumeRequest{
+			MaxWait: durationpb.New(5 * time.Second),
+		})
+		consumed <- err
+	}()
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	// Assert - the waiting consumer receives it
+	require.NoError(t, <-consumed)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSConfig configures the certificates of the servers.
+type TLSConfig struct {
+	CertFile string // certificate of the server, in PEM
+	KeyFile  string // private key of the certificate, in PEM
+	// ClientCAFile is the CA which signs the client certificates, in PEM.
+	// If set, the gRPC server only accepts clients with such a certificate
+	// (mutual TLS).
+	ClientCAFile string
+}
+
+// ServerTLSConfig returns the TLS configuration of the gRPC server.
+func (c *TLSConfig) ServerTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(c.ClientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientCredentials returns the credentials of a client of the gRPC server.
+// caFile is the CA which signs the certificate of the server; if empty,
+// the CAs of the system are used. certFile and keyFile are the certificate
+// of the client for mutual TLS and may be empty otherwise.
+func ClientCredentials(caFile, certFile, keyFile string) (credentials.TransportCredentials, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if caFile != "" {
+		if config.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// loadCertPool returns a pool of the certificates of a PEM file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/sota0121/proglog/api/v1"
+	"github.com/sota0121/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestTLS(t *testing.T) {
+	testMap := map[string]func(t *testing.T, ca, other *testCA){
+		"client with a certificate of the CA succeeds":   testTLSClientCert,
+		"client without a certificate fails":             testTLSNoClientCert,
+		"client with a certificate of another CA fails":  testTLSOtherClientCert,
+		"client which doesn't trust the server fails":    testTLSUntrustedServer,
+		"client without a certificate succeeds with TLS": testTLSServerOnly,
+		"insecure client fails":                          testTLSInsecureClient,
+	}
+
+	for scenario, fn := range testMap {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "tls-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			fn(t, newTestCA(t, dir, "ca"), newTestCA(t, dir, "other"))
+		})
+	}
+}
+
+func testTLSClientCert(t *testing.T, ca, _ *testCA) {
+	addr := setupTLSTest(t, ca.serverTLS(t, true))
+	certFile, keyFile := ca.issue(t, "client", false)
+	creds, err := ClientCredentials(ca.file, certFile, keyFile)
+	require.NoError(t, err)
+	require.NoError(t, produce(t, addr, creds))
+}
+
+func testTLSNoClientCert(t *testing.T, ca, _ *testCA) {
+	addr := setupTLSTest(t, ca.serverTLS(t, true))
+	creds, err := ClientCredentials(ca.file, "", "")
+	require.NoError(t, err)
+	require.Error(t, produce(t, addr, creds))
+}
+
+func testTLSOtherClientCert(t *testing.T, ca, other *testCA) {
+	addr := setupTLSTest(t, ca.serverTLS(t, true))
+	certFile, keyFile := other.issue(t, "client", false)
+	creds, err := ClientCredentials(ca.file, certFile, keyFile)
+	require.NoError(t, err)
+	require.Error(t, produce(t, addr, creds))
+}
+
+func testTLSUntrustedServer(t *testing.T, ca, other *testCA) {
+	addr := setupTLSTest(t, ca.serverTLS(t, true))
+	certFile, keyFile := ca.issue(t, "client", false)
+	creds, err := ClientCredentials(other.file, certFile, keyFile)
+	require.NoError(t, err)
+	require.Error(t, produce(t, addr, creds))
+}
+
+func testTLSServerOnly(t *testing.T, ca, _ *testCA) {
+	addr := setupTLSTest(t, ca.serverTLS(t, false))
+	creds, err := ClientCredentials(ca.file, "", "")
+	require.NoError(t, err)
+	require.NoError(t, produce(t, addr, creds))
+}
+
+func testTLSInsecureClient(t *testing.T, ca, _ *testCA) {
+	addr := setupTLSTest(t, ca.serverTLS(t, false))
+	require.Error(t, produce(t, addr, insecure.NewCredentials()))
+}
+
+// produce produces a record to the server at addr with the credentials.
+func produce(t *testing.T, addr string, creds credentials.TransportCredentials) error {
+	t.Helper()
+	cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	require.NoError(t, err)
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = api.NewLogClient(cc).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	return err
+}
+
+// setupTLSTest starts a server with the TLS configuration and returns its address.
+func setupTLSTest(t *testing.T, tlsConfig *TLSConfig) string {
+	t.Helper()
+	return setupConfigTest(t, &Config{TLS: tlsConfig})
+}
+
+// setupConfigTest starts a server with the config and a new commit log
+// and returns its address.
+func setupConfigTest(t *testing.T, config *Config) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "server-tls-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	config.CommitLog = clog
+	server, err := NewGRPCServer(config)
+	require.NoError(t, err)
+	go func() {
+		server.Serve(l)
+	}()
+
+	t.Cleanup(func() {
+		server.Stop()
+		l.Close()
+		clog.Remove()
+	})
+	return l.Addr().String()
+}
+
+// testCA is a throwaway certificate authority which issues
+// the certificates of the tests.
+type testCA struct {
+	dir  string
+	name string
+	file string // certificate of the CA, in PEM
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA creates a CA and writes its certificate to dir.
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	ca := &testCA{
+		dir:  dir,
+		name: name,
+		file: filepath.Join(dir, name+".pem"),
+		cert: cert,
+		key:  key,
+	}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// issue issues a certificate for the common name, which is valid
+// for a server on the loopback address if server is true.
+// It returns the files of the certificate and of its key.
+func (ca *testCA) issue(t *testing.T, cn string, server bool) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		template.DNSNames = []string{"localhost"}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	name := ca.name + "-" + cn
+	certFile = filepath.Join(ca.dir, name+".pem")
+	keyFile = filepath.Join(ca.dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+// serverTLS returns the TLS configuration of a server with a certificate
+// of the CA, which requires client certificates of the CA if mutual is true.
+func (ca *testCA) serverTLS(t *testing.T, mutual bool) *TLSConfig {
+	t.Helper()
+	certFile, keyFile := ca.issue(t, "server", true)
+	c := &TLSConfig{CertFile: certFile, KeyFile: keyFile}
+	if mutual {
+		c.ClientCAFile = ca.file
+	}
+	return c
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.NoError(t, os.WriteFile(file, b, 0600))
+}